@@ -0,0 +1,152 @@
+package simplelru
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// Number of counters per key in the frequency sketch
+const sketchDepth = 4
+
+// Max value of a sketch counter
+const sketchMaxCount = 15
+
+// Min number of counters per row, so small caches have few collisions
+const sketchMinWidth = 64
+
+// frequencySketch is a count-min sketch estimating how many times each key
+// was accessed recently. Counters saturate at sketchMaxCount, and all of
+// them are halved every resetAfter increments so old accesses fade away.
+type frequencySketch struct {
+	rows       [sketchDepth][]uint8
+	mask       uint64
+	additions  int
+	resetAfter int
+}
+
+// newFrequencySketch creates a sketch sized for a cache of size entries
+func newFrequencySketch(size int) *frequencySketch {
+	width := sketchMinWidth
+	for width < size {
+		width <<= 1
+	}
+	s := &frequencySketch{
+		mask:       uint64(width - 1),
+		resetAfter: 10 * size,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// index returns the counter of key in row i
+func (s *frequencySketch) index(hash uint64, i int) uint64 {
+	h1, h2 := hash, hash>>32|hash<<32
+	return (h1 + uint64(i)*h2) & s.mask
+}
+
+// Increment counts an access to key
+func (s *frequencySketch) Increment(key interface{}) {
+	hash := hashKey(key)
+	for i := range s.rows {
+		if n := &s.rows[i][s.index(hash, i)]; *n < sketchMaxCount {
+			*n++
+		}
+	}
+
+	if s.additions++; s.additions >= s.resetAfter {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] /= 2
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+// Estimate returns the estimated access count of key
+func (s *frequencySketch) Estimate(key interface{}) uint8 {
+	hash := hashKey(key)
+	min := uint8(sketchMaxCount)
+	for i := range s.rows {
+		if n := s.rows[i][s.index(hash, i)]; n < min {
+			min = n
+		}
+	}
+	return min
+}
+
+// hashKey returns a hash of any comparable key. Strings and integers are
+// hashed directly, other types are hashed from their printed value.
+func hashKey(key interface{}) uint64 {
+	switch k := key.(type) {
+	case string:
+		return hashString(k)
+	case int:
+		return mix64(uint64(k))
+	case int64:
+		return mix64(uint64(k))
+	case int32:
+		return mix64(uint64(k))
+	case uint:
+		return mix64(uint64(k))
+	case uint64:
+		return mix64(k)
+	case uint32:
+		return mix64(uint64(k))
+	default:
+		return hashString(fmt.Sprintf("%T%v", key, key))
+	}
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return mix64(h.Sum64())
+}
+
+// mix64 is the splitmix64 finalizer, spreads the bits of x over the hash
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// WithAdmissionFilter enables a TinyLFU admission policy, improving the hit
+// ratio of workloads with a skewed popularity like Zipf distributions. The
+// accesses to each key (Get and Set calls, cached or not) are counted in a
+// small frequency sketch, and when the cache is full a new key is only
+// admitted if it was accessed more often than the entry that would be
+// evicted for it, otherwise the new value isn't cached and no entry is
+// evicted. Keys that are rarely accessed can't push popular entries out.
+//
+// Rejected values are still returned by Get when they are fetched, and Set
+// returns false, like when only pinned entries are left. The frequencies
+// are approximate and fade over time, so a key that becomes popular is
+// eventually admitted. The victim compared is the oldest entry (the newest
+// with WithMRUEviction), even when WithSampledEviction picks another one.
+func WithAdmissionFilter() Option {
+	return func(c *LRUCache) {
+		c.sketch = newFrequencySketch(c.size)
+	}
+}
+
+// admit returns true if key may be inserted in a full cache, evicting the
+// entry that would be evicted next. Must be called with the lock held.
+func (c *LRUCache) admit(key interface{}) bool {
+	if c.sketch == nil {
+		return true
+	}
+	var victim interface{}
+	var ok bool
+	if c.evictNewest {
+		victim, _, ok = c.cache.GetLast()
+	} else {
+		victim, _, ok = c.cache.GetFirst()
+	}
+	return !ok || c.sketch.Estimate(key) > c.sketch.Estimate(victim)
+}
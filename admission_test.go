@@ -0,0 +1,134 @@
+package simplelru
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestFrequencySketch(t *testing.T) {
+	s := newFrequencySketch(64)
+	for i := 0; i < 5; i++ {
+		s.Increment("hot")
+	}
+	s.Increment(1)
+
+	if n := s.Estimate("hot"); n != 5 {
+		t.Error(fmt.Sprintf("Expected hot estimate 5 got %v", n))
+	}
+	if n := s.Estimate(1); n != 1 {
+		t.Error(fmt.Sprintf("Expected 1 estimate 1 got %v", n))
+	}
+	if n := s.Estimate(struct{ A int }{1}); n != 0 {
+		t.Error(fmt.Sprintf("Expected unseen key estimate 0 got %v", n))
+	}
+
+	// Counters saturate
+	for i := 0; i < 100; i++ {
+		s.Increment("hot")
+	}
+	if n := s.Estimate("hot"); n > sketchMaxCount {
+		t.Error(fmt.Sprintf("Counter above max %v", n))
+	}
+
+	// And are halved after resetAfter increments
+	s = newFrequencySketch(4)
+	for i := 0; i < 6; i++ {
+		s.Increment("a")
+	}
+	before := s.Estimate("a")
+	for i := 0; i < s.resetAfter; i++ {
+		s.Increment(i + 100)
+	}
+	if after := s.Estimate("a"); after >= before {
+		t.Error(fmt.Sprintf("Counters weren't halved %v -> %v", before, after))
+	}
+}
+
+func TestAdmissionFilter(t *testing.T) {
+	cache := NewLRUCache(2, 1, WithAdmissionFilter())
+	cache.Set(1, 1)
+	cache.Set(2, 2)
+	cache.Get(1)
+	cache.Get(2)
+
+	// A key seen once doesn't replace a popular entry
+	if cache.Set(3, 3) || cache.Contains(3) || cache.Len() != 2 {
+		t.Error("A cold key was admitted")
+	}
+
+	// But it is admitted once it is accessed more than the victim
+	cache.Get(3)
+	cache.Set(3, 3)
+	if !cache.Contains(3) || cache.Contains(1) {
+		t.Error("A popular key wasn't admitted")
+	}
+
+	// Updating cached keys is never filtered
+	cache.Set(2, 20)
+	if value, _ := cache.Peek(2); value != 20 {
+		t.Error("Update of a cached key was rejected")
+	}
+}
+
+// Test rejected fetched values are returned but not cached
+func TestFetchAdmissionFilter(t *testing.T) {
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		return key, true
+	}
+	cache := NewFetchingLRUCache(1, 1, fetcher, 1, 1, WithAdmissionFilter())
+	cache.Get(1)
+	cache.Get(1)
+
+	var filled bool
+	value, ok := cache.GetWithFill(2, func(key, value interface{}) {
+		filled = true
+	})
+	if !ok || value != 2 {
+		t.Error("Rejected fetched value wasn't returned")
+	}
+	if filled || cache.Contains(2) {
+		t.Error("Rejected fetched value was cached")
+	}
+	cache.Close()
+}
+
+// zipfHitRatio returns the hit ratio of a cache for a Zipf distributed
+// workload
+func zipfHitRatio(cache *LRUCache, requests int, seed int64) float64 {
+	zipf := rand.NewZipf(rand.New(rand.NewSource(seed)), 1.01, 1, 100000)
+	hits := 0
+	for i := 0; i < requests; i++ {
+		key := zipf.Uint64()
+		if _, ok := cache.Get(key); ok {
+			hits++
+		} else {
+			cache.Set(key, key)
+		}
+	}
+	return float64(hits) / float64(requests)
+}
+
+// Test the admission filter improves the hit ratio of a Zipf workload
+func TestAdmissionFilterHitRatio(t *testing.T) {
+	lru := zipfHitRatio(NewLRUCache(1000, 1), 200000, 1)
+	tinyLFU := zipfHitRatio(NewLRUCache(1000, 1, WithAdmissionFilter()), 200000, 1)
+	if tinyLFU <= lru {
+		t.Error(fmt.Sprintf("Admission filter hit ratio %.3f not above LRU %.3f", tinyLFU, lru))
+	}
+}
+
+func benchmarkZipf(b *testing.B, opts ...Option) {
+	cache := NewLRUCache(1000, 1, opts...)
+	b.ResetTimer()
+	ratio := zipfHitRatio(cache, b.N, 1)
+	b.ReportMetric(ratio, "hit-ratio")
+}
+
+func BenchmarkZipfLRU(b *testing.B) {
+	benchmarkZipf(b)
+}
+
+func BenchmarkZipfAdmissionFilter(b *testing.B) {
+	benchmarkZipf(b, WithAdmissionFilter())
+}
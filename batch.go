@@ -0,0 +1,120 @@
+package simplelru
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// BatchFetchFunc looks up the values of a batch of missing keys, returning
+// the values found. Keys not in the returned map weren't found.
+type BatchFetchFunc func(keys []interface{}) (map[interface{}]interface{}, error)
+
+// WithBatchFetcher sets a function used by GetMulti to fetch all the missing
+// keys with a single call. Get doesn't use it.
+func WithBatchFetcher(fetcher BatchFetchFunc) Option {
+	return func(c *LRUCache) {
+		c.batchFetcher = fetcher
+	}
+}
+
+// GetMulti returns the values of a batch of keys, keys not found are not in
+// the returned map. The missing keys are fetched with a single call to the
+// batch fetcher (see WithBatchFetcher) from the calling goroutine, except
+// those already being fetched by other Get or GetMulti calls, which are
+// waited for instead. The fetched values are cached. If the batch fetcher
+// fails the error is returned along with the values found, and the keys it
+// was fetching are misses for all the callers waiting for them.
+//
+// Without a batch fetcher the missing keys are fetched like in Get.
+//
+// After Close the missing keys aren't fetched, and ErrClosed is returned
+// along with the cached values if any key is missing.
+func (c *LRUCache) GetMulti(keys []interface{}) (map[interface{}]interface{}, error) {
+	if c.batchFetcher == nil {
+		values, _ := c.GetMultiContext(context.Background(), keys)
+		return values, c.closedMiss(keys, values)
+	}
+
+	values := make(map[interface{}]interface{}, len(keys))
+	requests := make(map[interface{}]*fetchRequest)
+	var batch []*fetchRequest
+
+	c.Lock()
+	for _, key := range keys {
+		if _, seen := requests[key]; seen {
+			continue
+		}
+		if value, ok := c.lookup(key, true); ok {
+			values[key] = value
+			continue
+		}
+		request, isNew := c.joinFetch(key)
+		if request == nil {
+			continue
+		}
+		requests[key] = request
+		if isNew {
+			batch = append(batch, request)
+		}
+	}
+	c.Unlock()
+
+	var err error
+	if len(batch) > 0 {
+		err = c.fetchBatch(batch)
+	}
+
+	for key, request := range requests {
+		<-request.ready
+		if value, ok := c.requestResult(request); ok {
+			values[key] = value
+		}
+	}
+	if err == nil {
+		err = c.closedMiss(keys, values)
+	}
+	return values, err
+}
+
+// closedMiss returns ErrClosed if the cache is closed and any of the keys
+// is missing from values.
+func (c *LRUCache) closedMiss(keys []interface{}, values map[interface{}]interface{}) error {
+	for _, key := range keys {
+		if _, found := values[key]; !found {
+			if c.isClosed() {
+				return ErrClosed
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// fetchBatch fetches and completes a batch of new fetch requests
+func (c *LRUCache) fetchBatch(batch []*fetchRequest) error {
+	fetchKeys := make([]interface{}, len(batch))
+	for i, request := range batch {
+		fetchKeys[i] = request.key
+	}
+
+	start := time.Now()
+	found, err := c.batchFetcher(fetchKeys)
+	atomic.AddInt64(&c.fetchNanos, int64(time.Since(start)))
+	atomic.AddUint64(&c.fetchCount, 1)
+
+	c.Lock()
+	for _, request := range batch {
+		ckey := c.coalesceKey(request.key)
+		if c.fetchM[ckey] != request {
+			continue // Already finished by Set or Close
+		}
+		value, ok := found[request.key]
+		if err != nil {
+			value, ok = nil, false
+		}
+		c.completeRequest(ckey, request, value, ok)
+	}
+	c.Unlock()
+	return err
+}
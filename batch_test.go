@@ -0,0 +1,118 @@
+package simplelru
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Mock batch backing store
+type batchStore struct {
+	batches [][]interface{}
+	fail    bool
+	delay   time.Duration
+	lock    sync.Mutex
+}
+
+func (s *batchStore) Fetch(keys []interface{}) (map[interface{}]interface{}, error) {
+	time.Sleep(s.delay)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.batches = append(s.batches, keys)
+	if s.fail {
+		return nil, errors.New("batch fetch failed")
+	}
+	values := make(map[interface{}]interface{})
+	for _, key := range keys {
+		if k, ok := key.(int); ok && k >= 0 {
+			values[key] = k * 10
+		}
+	}
+	return values, nil
+}
+
+func (s *batchStore) Batches() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.batches)
+}
+
+func TestGetMulti(t *testing.T) {
+	store := &batchStore{}
+	cache := NewLRUCache(100, 1, WithBatchFetcher(store.Fetch))
+	cache.Set(1, "cached")
+
+	values, err := cache.GetMulti([]interface{}{1, 2, 3, -1, 2})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(values) != 3 || values[1] != "cached" || values[2] != 20 || values[3] != 30 {
+		t.Error(fmt.Sprintf("Unexpected values %v", values))
+	}
+
+	// A single batch with the missing keys
+	if len(store.batches) != 1 || fmt.Sprint(store.batches[0]) != "[2 3 -1]" {
+		t.Error(fmt.Sprintf("Unexpected batches %v", store.batches))
+	}
+	if !cache.Contains(2) || !cache.Contains(3) || cache.Contains(-1) {
+		t.Error("The fetched values weren't cached")
+	}
+
+	// No fetch when all the keys are cached
+	cache.GetMulti([]interface{}{1, 2, 3})
+	if store.Batches() != 1 {
+		t.Error("GetMulti fetched cached keys")
+	}
+
+	// Errors
+	store.fail = true
+	values, err = cache.GetMulti([]interface{}{1, 4})
+	if err == nil || len(values) != 1 || cache.Contains(4) {
+		t.Error("GetMulti didn't return the batch fetcher error")
+	}
+
+	// Closed cache
+	store.fail = false
+	cache.Close()
+	if _, err := cache.GetMulti([]interface{}{1, 2}); err != nil {
+		t.Error("GetMulti failed after Close with all the keys cached")
+	}
+	if values, err := cache.GetMulti([]interface{}{1, 5}); err != ErrClosed || len(values) != 1 {
+		t.Error(fmt.Sprintf("GetMulti returned %v %v after Close", values, err))
+	}
+	if store.Batches() != 2 {
+		t.Error("GetMulti fetched after Close")
+	}
+
+	cache = NewLRUCache(10, 1)
+	cache.Close()
+	if _, err := cache.GetMulti([]interface{}{1}); err != ErrClosed {
+		t.Error("GetMulti without batch fetcher didn't return ErrClosed")
+	}
+}
+
+func TestGetMultiCoalescing(t *testing.T) {
+	store := &batchStore{delay: 30 * time.Millisecond}
+	cache := NewLRUCache(100, 1, WithBatchFetcher(store.Fetch))
+
+	// Concurrent batches don't fetch the same keys twice
+	var wg sync.WaitGroup
+	for _, keys := range [][]interface{}{{1, 2}, {2, 3}} {
+		wg.Add(1)
+		go func(keys []interface{}) {
+			defer wg.Done()
+			values, _ := cache.GetMulti(keys)
+			if len(values) != 2 {
+				t.Error(fmt.Sprintf("Unexpected values %v", values))
+			}
+		}(keys)
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if fmt.Sprint(store.batches) != "[[1 2] [3]]" {
+		t.Error(fmt.Sprintf("Unexpected batches %v", store.batches))
+	}
+}
@@ -0,0 +1,38 @@
+package simplelru
+
+// CloneFunc returns an independent copy of a value
+type CloneFunc func(value interface{}) interface{}
+
+// WithValueClone makes the cache hand out copies of the values made by
+// clone, so callers can modify mutable values (slices, maps, pointers)
+// without racing with other callers or changing the cached value. Cache
+// hits in Get, its variants and Peek return a copy, and so do fetches,
+// where every caller waiting for the same fetch gets its own copy while the
+// cache keeps the original. Values passed to callbacks, and the entries
+// returned by OldestN, NewestN, ToMap and the like aren't copied.
+// CompareAndSwap and CompareAndDelete compare old with the cached original,
+// so a pointer value returned by Get never matches, being a copy.
+//
+// Every returned value is copied, so reads cost as much as clone, and hits
+// are copied with the cache locked. clone must not call any cache method.
+// Without it (the default) all the callers share the cached value.
+func WithValueClone(clone CloneFunc) Option {
+	return func(c *LRUCache) {
+		c.clone = clone
+	}
+}
+
+// cloneValue returns a copy of value if it was found and there is a clone
+// function, otherwise value itself.
+func (c *LRUCache) cloneValue(value interface{}, ok bool) (interface{}, bool) {
+	if !ok || c.clone == nil {
+		return value, ok
+	}
+	return c.clone(value), true
+}
+
+// requestResult returns the value of a finished fetch request, copied for
+// the caller.
+func (c *LRUCache) requestResult(request *fetchRequest) (interface{}, bool) {
+	return c.cloneValue(request.value, request.ok)
+}
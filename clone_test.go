@@ -0,0 +1,109 @@
+package simplelru
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cloneSlice copies []int values
+func cloneSlice(value interface{}) interface{} {
+	return append([]int(nil), value.([]int)...)
+}
+
+func TestValueClone(t *testing.T) {
+	cache := NewLRUCache(10, 1, WithValueClone(cloneSlice))
+	cache.Set(1, []int{1, 2, 3})
+
+	value, _ := cache.Get(1)
+	value.([]int)[0] = 100
+	peeked, _ := cache.Peek(1)
+	peeked.([]int)[1] = 200
+
+	if value, _ := cache.Get(1); fmt.Sprint(value) != "[1 2 3]" {
+		t.Error(fmt.Sprintf("Modifying a returned value changed the cached one %v", value))
+	}
+
+	// Misses aren't cloned
+	if value, ok := cache.Get(2); ok || value != nil {
+		t.Error("Unexpected value for a missing key")
+	}
+
+	// Miss handler values are cached and copied
+	cache.SetMissHandler(func(key interface{}) (interface{}, bool) {
+		return []int{key.(int)}, true
+	})
+	value, _ = cache.Get(5)
+	value.([]int)[0] = 100
+	if value, _ := cache.Peek(5); fmt.Sprint(value) != "[5]" {
+		t.Error(fmt.Sprintf("Miss handler value wasn't copied %v", value))
+	}
+
+	// Without clone function the value is shared
+	shared := NewLRUCache(10, 1)
+	shared.Set(1, []int{1})
+	value, _ = shared.Get(1)
+	value.([]int)[0] = 100
+	if value, _ := shared.Get(1); fmt.Sprint(value) != "[100]" {
+		t.Error("Value was copied without clone function")
+	}
+}
+
+// Test CompareAndSwap compares with the cached original, not the copies
+func TestValueCloneCompareAndSwap(t *testing.T) {
+	type box struct{ n int }
+	clone := func(value interface{}) interface{} {
+		b := *value.(*box)
+		return &b
+	}
+	cache := NewLRUCache(10, 1, WithValueClone(clone))
+	original := &box{1}
+	cache.Set(1, original)
+
+	copied, _ := cache.Get(1)
+	if cache.CompareAndSwap(1, copied, &box{2}) || cache.CompareAndDelete(1, copied) {
+		t.Error("A copy matched the cached value")
+	}
+	if !cache.CompareAndSwap(1, original, &box{2}) {
+		t.Error("The cached original didn't match")
+	}
+}
+
+// Test every caller waiting for a fetch gets its own copy
+func TestFetchValueClone(t *testing.T) {
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		return []int{key.(int)}, true
+	}
+
+	before := newSeam()
+	cache := NewFetchingLRUCache(10, 1, fetcher, 1, 10,
+		WithValueClone(cloneSlice),
+		withWorkerHooks(workerHooks{beforeFetch: before.hook}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, _ := cache.Get(1)
+			value.([]int)[0]++ // Races if the value is shared
+		}()
+	}
+	<-before.reached
+	for _, miss := cache.Stats(); miss < 4; _, miss = cache.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+	close(before.release)
+	wg.Wait()
+
+	if value, _ := cache.Peek(1); fmt.Sprint(value) != "[1]" {
+		t.Error(fmt.Sprintf("The waiters modified the cached value %v", value))
+	}
+	results := cache.GetOrdered([]interface{}{1, 1})
+	results[0].Value.([]int)[0] = 100
+	if fmt.Sprint(results[1].Value) != "[1]" {
+		t.Error("GetOrdered results share the value")
+	}
+	cache.Close()
+}
@@ -0,0 +1,33 @@
+package simplelru
+
+import (
+	"errors"
+
+	"github.com/secnot/simplelru/orderedmap"
+)
+
+var (
+	// ErrNotFound is returned by GetE when the key isn't cached and can't
+	// be fetched
+	ErrNotFound = errors.New("LRUCache: Not found")
+
+	// ErrClosed is returned instead of ErrNotFound for the misses of a
+	// closed cache, which doesn't fetch missing keys anymore
+	ErrClosed = errors.New("LRUCache: Closed")
+
+	// ErrBusy is returned by GetE when the max number of concurrent gets
+	// is reached
+	ErrBusy = errors.New("LRUCache: Busy")
+
+	// ErrFrozen is returned by Put when the cache is frozen, without
+	// writing the value
+	ErrFrozen = errors.New("LRUCache: Frozen")
+
+	// ErrPanicked is returned by Do to the callers waiting for a call that
+	// panicked
+	ErrPanicked = errors.New("LRUCache: Call panicked")
+
+	// ErrConcurrentModification is returned by Iterator.Err when the cache
+	// was modified during the iteration
+	ErrConcurrentModification = orderedmap.ErrConcurrentModification
+)
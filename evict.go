@@ -0,0 +1,65 @@
+package simplelru
+
+import (
+	"io"
+	"reflect"
+)
+
+// EvictFunc is called with the entries evicted from the cache
+type EvictFunc func(key interface{}, value interface{})
+
+// SetOnEvict sets a function called for each entry pruned to make room for
+// new ones, including the entries pruned by Resize. Entries removed
+// explicitly or by Purge aren't evictions. It is called with the cache
+// locked so it must not call any cache method.
+func (c *LRUCache) SetOnEvict(onEvict EvictFunc) {
+	c.Lock()
+	c.onEvict = onEvict
+	c.Unlock()
+}
+
+// SetAutoCloseValues enables closing the cached values that implement
+// io.Closer when they leave the cache because they are evicted, removed
+// (Remove, RemovePrefix, RemoveOldest, RemoveNewest), replaced by a
+// different value, or purged. Values returned by PopOldest and PopNewest
+// belong to the caller and are not closed.
+//
+// Values are closed with the cache locked, slow Close methods block the
+// cache.
+func (c *LRUCache) SetAutoCloseValues(enable bool) {
+	c.Lock()
+	c.autoClose = enable
+	c.Unlock()
+}
+
+// SetCloseErrorHandler sets a function called with the errors returned by
+// the values closed by SetAutoCloseValues, by default they are ignored. It is
+// called with the cache locked so it must not call any cache method.
+func (c *LRUCache) SetCloseErrorHandler(onErr func(key interface{}, err error)) {
+	c.Lock()
+	c.onCloseErr = onErr
+	c.Unlock()
+}
+
+// discard releases a value that is no longer cached, closing it when
+// auto-close is enabled.
+func (c *LRUCache) discard(key interface{}, value interface{}) {
+	if !c.autoClose {
+		return
+	}
+	if closer, ok := value.(io.Closer); ok {
+		if err := closer.Close(); err != nil && c.onCloseErr != nil {
+			c.onCloseErr(key, err)
+		}
+	}
+}
+
+// sameValue returns true if a and b are the same value, without panicking
+// on uncomparable types.
+func sameValue(a interface{}, b interface{}) bool {
+	ta := reflect.TypeOf(a)
+	if ta != reflect.TypeOf(b) || (ta != nil && !ta.Comparable()) {
+		return false
+	}
+	return a == b
+}
@@ -0,0 +1,140 @@
+package simplelru
+
+import (
+	"errors"
+	"testing"
+)
+
+// Mock resource counting Close calls
+type closer struct {
+	closed int
+	err    error
+}
+
+func (c *closer) Close() error {
+	c.closed++
+	return c.err
+}
+
+func TestOnEvict(t *testing.T) {
+	cache := NewLRUCache(3, 1)
+	evicted := []interface{}{}
+	cache.SetOnEvict(func(key interface{}, value interface{}) {
+		evicted = append(evicted, key)
+	})
+
+	for i := 0; i < 4; i++ {
+		cache.Set(i, i)
+	}
+	if len(evicted) != 1 || evicted[0] != 0 {
+		t.Errorf("Evicted keys %v expecting [0]", evicted)
+	}
+
+	// Explicit removals aren't evictions
+	cache.Remove(1)
+	cache.PopOldest()
+	if len(evicted) != 1 {
+		t.Error("Removed key reported as evicted")
+	}
+
+	// Resize prunes are
+	cache.Set(4, 4)
+	cache.Set(5, 5)
+	cache.Resize(1, 1)
+	if len(evicted) != 3 || evicted[1] != 3 || evicted[2] != 4 {
+		t.Errorf("Evicted keys %v expecting [0 3 4]", evicted)
+	}
+}
+
+// Test shrinking the cache reports every pruned entry, with its value, and
+// releases the values like any other eviction.
+func TestResizeEvictions(t *testing.T) {
+	cache := NewLRUCache(10, 1, WithEvictionTracking(10))
+	cache.SetAutoCloseValues(true)
+	evicted := map[interface{}]interface{}{}
+	cache.SetOnEvict(func(key interface{}, value interface{}) {
+		evicted[key] = value
+	})
+
+	values := make([]*closer, 10)
+	for i := range values {
+		values[i] = &closer{}
+		cache.Set(i, values[i])
+	}
+	cache.Get(0)
+
+	cache.Resize(4, 1)
+	if len(evicted) != 6 {
+		t.Errorf("Expected 6 evictions got %v", len(evicted))
+	}
+	for i := 1; i <= 6; i++ {
+		if evicted[i] != values[i] || values[i].closed != 1 {
+			t.Errorf("Entry %v wasn't evicted and closed", i)
+		}
+	}
+	if values[0].closed != 0 || values[7].closed != 0 {
+		t.Error("Kept values were closed")
+	}
+	if top := cache.TopEvicted(10); len(top) != 6 {
+		t.Errorf("Resize evictions weren't tracked %v", top)
+	}
+	if rate := cache.EvictionRate(); rate <= 0 {
+		t.Error("Resize evictions aren't in the eviction rate")
+	}
+}
+
+func TestAutoCloseValues(t *testing.T) {
+	cache := NewLRUCache(2, 1)
+	values := make([]*closer, 7)
+	for i := range values {
+		values[i] = &closer{}
+	}
+
+	// Disabled by default
+	cache.Set(0, values[0])
+	cache.Remove(0)
+	if values[0].closed != 0 {
+		t.Error("Value closed without auto-close")
+	}
+
+	cache.SetAutoCloseValues(true)
+
+	// Eviction
+	cache.Set(1, values[1])
+	cache.Set(2, values[2])
+	cache.Set(3, values[3])
+	if values[1].closed != 1 {
+		t.Error("Evicted value wasn't closed")
+	}
+
+	// Replacement, setting the same value again doesn't close it
+	cache.Set(3, values[3])
+	cache.Set(2, values[4])
+	if values[2].closed != 1 || values[3].closed != 0 {
+		t.Error("Replaced value wasn't closed")
+	}
+
+	// Popped values belong to the caller
+	if _, v, _ := cache.PopOldest(); v != values[3] || values[3].closed != 0 {
+		t.Error("Popped value was closed")
+	}
+
+	// Removal
+	cache.Remove(2)
+	if values[4].closed != 1 {
+		t.Error("Removed value wasn't closed")
+	}
+
+	// Purge, and close errors
+	var closeErr error
+	cache.SetCloseErrorHandler(func(key interface{}, err error) {
+		closeErr = err
+	})
+	values[5].err = errors.New("close failed")
+	cache.Set(5, values[5])
+	cache.Set("not a closer", 6)
+	cache.Purge()
+	if values[5].closed != 1 || closeErr != values[5].err {
+		t.Error("Purged value wasn't closed")
+	}
+}
@@ -53,3 +53,61 @@ func ExampleNewLRUCache() {
 	// 11 was removed from cache
 	// 10 is still here
 }
+
+// Bounded FIFO queue, using Peek instead of Get to access the items so
+// the insertion order is never modified.
+func ExampleLRUCache_Oldest() {
+
+	queue := simplelru.NewLRUCache(3, 1)
+
+	// Queueing a fourth item drops the oldest one
+	for i := 1; i <= 4; i++ {
+		queue.Set(i, fmt.Sprintf("job %v", i))
+	}
+
+	// Next item in the queue
+	if _, value, ok := queue.Oldest(); ok {
+		fmt.Println("next:", value)
+	}
+
+	// Last item queued
+	if _, value, ok := queue.Newest(); ok {
+		fmt.Println("last:", value)
+	}
+
+	// Dequeue all
+	for {
+		_, value, ok := queue.PopOldest()
+		if !ok {
+			break
+		}
+		fmt.Println(value)
+	}
+
+	// Output:
+	// next: job 2
+	// last: job 4
+	// job 2
+	// job 3
+	// job 4
+}
+
+// Struct keys are compared by value, no need to build string keys.
+func ExampleNewLRUCache_structKeys() {
+	type userKey struct {
+		Tenant string
+		ID     int
+	}
+
+	cache := simplelru.NewLRUCache(100, 1)
+	cache.Set(userKey{"acme", 1}, "Wile E. Coyote")
+
+	value, ok := cache.Get(userKey{"acme", 1})
+	fmt.Println(value, ok)
+
+	_, ok = cache.Get(userKey{"other", 1})
+	fmt.Println(ok)
+	// Output:
+	// Wile E. Coyote true
+	// false
+}
@@ -0,0 +1,77 @@
+package simplelru
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// WithPriorityQueue makes the fetch workers serve the queued fetches by
+// priority instead of in arrival order, see GetWithPriority. Fetches with
+// the same priority are served in arrival order.
+func WithPriorityQueue() Option {
+	return func(c *LRUCache) {
+		c.prioQ = newFetchQueue(cap(c.fetchQ))
+	}
+}
+
+// fetchItem is a key queued for fetch
+type fetchItem struct {
+	key  interface{}
+	prio int
+	seq  uint64 // Arrival order
+}
+
+// fetchItems implements heap.Interface, highest priority first
+type fetchItems []fetchItem
+
+func (f fetchItems) Len() int { return len(f) }
+
+func (f fetchItems) Less(i, j int) bool {
+	if f[i].prio != f[j].prio {
+		return f[i].prio > f[j].prio
+	}
+	return f[i].seq < f[j].seq
+}
+
+func (f fetchItems) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+
+func (f *fetchItems) Push(x interface{}) { *f = append(*f, x.(fetchItem)) }
+
+func (f *fetchItems) Pop() interface{} {
+	old := *f
+	item := old[len(old)-1]
+	old[len(old)-1] = fetchItem{}
+	*f = old[:len(old)-1]
+	return item
+}
+
+// fetchQueue is a priority queue of keys waiting to be fetched. The size is
+// limited by fetchQ, each queued key has a token in ready.
+type fetchQueue struct {
+	sync.Mutex
+	items fetchItems
+	seq   uint64
+	ready chan struct{}
+}
+
+func newFetchQueue(size int) *fetchQueue {
+	return &fetchQueue{ready: make(chan struct{}, size)}
+}
+
+// Push queues a key, there must be a free slot in fetchQ
+func (q *fetchQueue) Push(key interface{}, prio int) {
+	q.Lock()
+	q.seq++
+	heap.Push(&q.items, fetchItem{key: key, prio: prio, seq: q.seq})
+	q.Unlock()
+	q.ready <- struct{}{}
+}
+
+// Pop returns the highest priority key, must only be called after receiving
+// a ready token.
+func (q *fetchQueue) Pop() interface{} {
+	q.Lock()
+	item := heap.Pop(&q.items).(fetchItem)
+	q.Unlock()
+	return item.key
+}
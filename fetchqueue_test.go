@@ -0,0 +1,81 @@
+package simplelru
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	release := make(chan struct{})
+	var order []interface{}
+	var lock sync.Mutex
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		if key == "first" {
+			<-release
+		}
+		lock.Lock()
+		order = append(order, key)
+		lock.Unlock()
+		return key, true
+	}
+
+	// A single worker so the fetches are serialized
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 10, WithPriorityQueue())
+	go cache.Get("first")
+	time.Sleep(10 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	prios := map[interface{}]int{"low": -1, "normal1": 0, "high": 10, "normal2": 0, "highest": 20}
+	for _, key := range []interface{}{"low", "normal1", "high", "normal2", "highest"} {
+		wg.Add(1)
+		go func(key interface{}) {
+			defer wg.Done()
+			cache.GetWithPriority(key, prios[key])
+		}(key)
+		time.Sleep(5 * time.Millisecond) // Keep arrival order
+	}
+	close(release)
+	wg.Wait()
+
+	expected := "[first highest high normal1 normal2 low]"
+	if fmt.Sprint(order) != expected {
+		t.Errorf("Fetch order %v expecting %v", order, expected)
+	}
+	cache.Close()
+}
+
+func TestPriorityQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		<-release
+		return key, true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 2, WithPriorityQueue())
+	cache.SetQueueFullPolicy(QueueDrop, 0)
+
+	// One fetch in progress and two queued fill the queue
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(key int) {
+			defer wg.Done()
+			cache.Get(key)
+		}(i)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := cache.GetWithPriority(10, 100); ok {
+		t.Error("The fetch should have been dropped")
+	}
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < 3; i++ {
+		if !cache.Contains(i) {
+			t.Error(fmt.Sprintf("Key %v wasn't fetched", i))
+		}
+	}
+	cache.Close()
+}
@@ -0,0 +1,35 @@
+package simplelru
+
+// withWorkerHooks sets the fetch worker test seams
+func withWorkerHooks(hooks workerHooks) Option {
+	return func(c *LRUCache) {
+		c.hooks = hooks
+	}
+}
+
+// seam is a worker hook that blocks the worker until released, so tests can
+// run operations at an exact point of the fetch.
+type seam struct {
+	reached chan interface{}
+	release chan struct{}
+}
+
+func newSeam() *seam {
+	return &seam{
+		reached: make(chan interface{}),
+		release: make(chan struct{}),
+	}
+}
+
+// hook signals the key reached the seam and waits to be released
+func (s *seam) hook(key interface{}) {
+	s.reached <- key
+	<-s.release
+}
+
+// notifier is a worker hook that reports the keys that reached it
+type notifier chan interface{}
+
+func (n notifier) hook(key interface{}) {
+	n <- key
+}
@@ -0,0 +1,113 @@
+package simplelru
+
+// HashFunc returns a hash of a value, equal values must have the same hash
+type HashFunc func(value interface{}) uint64
+
+// EqualFunc returns true if two values are identical
+type EqualFunc func(a interface{}, b interface{}) bool
+
+// WithValueInterning stores identical values only once, for caches where
+// many keys map to the same large value (content addressed blobs and the
+// like). When a value is cached, and a value equal to it (per equal) is
+// already cached for another key, the new key stores a reference to the
+// existing value instead, so both keys share the same object and the copy
+// can be garbage collected. hash must return the same hash for equal
+// values, it only narrows down the values compared with equal.
+//
+// The shared values must be immutable: modifying the value returned for
+// one key changes it for every key sharing it. For the same reason don't
+// combine it with SetAutoCloseValues, the shared value would be closed when
+// the first of its keys is removed. Both functions are called with the
+// cache locked, on every insert and removal, and must not call any cache
+// method. The weight of a shared value is still counted once per key.
+func WithValueInterning(hash HashFunc, equal EqualFunc) Option {
+	return func(c *LRUCache) {
+		if hash == nil || equal == nil {
+			panic("WithValueInterning: hash and equal funcs are required")
+		}
+		c.interned = newInternTable(hash, equal)
+	}
+}
+
+// internEntry is a distinct cached value and the number of keys storing it
+type internEntry struct {
+	value interface{}
+	refs  int
+}
+
+// internTable tracks the distinct cached values, grouped by hash
+type internTable struct {
+	hash    HashFunc
+	equal   EqualFunc
+	buckets map[uint64][]*internEntry
+	count   int
+}
+
+func newInternTable(hash HashFunc, equal EqualFunc) *internTable {
+	return &internTable{
+		hash:    hash,
+		equal:   equal,
+		buckets: make(map[uint64][]*internEntry),
+	}
+}
+
+// find returns the entry equal to value, or nil if there isn't one
+func (t *internTable) find(hash uint64, value interface{}) *internEntry {
+	for _, e := range t.buckets[hash] {
+		if t.equal(e.value, value) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Intern adds a reference to value and returns the shared value equal to
+// it, which is value itself when it wasn't already in the table.
+func (t *internTable) Intern(value interface{}) interface{} {
+	hash := t.hash(value)
+	if e := t.find(hash, value); e != nil {
+		e.refs++
+		return e.value
+	}
+	t.buckets[hash] = append(t.buckets[hash], &internEntry{value: value, refs: 1})
+	t.count++
+	return value
+}
+
+// Release removes a reference to value, dropping it from the table when no
+// key stores it anymore.
+func (t *internTable) Release(value interface{}) {
+	hash := t.hash(value)
+	bucket := t.buckets[hash]
+	for i, e := range bucket {
+		if !t.equal(e.value, value) {
+			continue
+		}
+		if e.refs--; e.refs > 0 {
+			return
+		}
+		if len(bucket) == 1 {
+			delete(t.buckets, hash)
+		} else {
+			bucket[i] = bucket[len(bucket)-1]
+			bucket[len(bucket)-1] = nil
+			t.buckets[hash] = bucket[:len(bucket)-1]
+		}
+		t.count--
+		return
+	}
+}
+
+// Len returns the number of distinct values
+func (t *internTable) Len() int {
+	return t.count
+}
+
+// intern returns the shared value equal to value if interning is enabled,
+// otherwise value itself. Must be called with the lock held.
+func (c *LRUCache) intern(value interface{}) interface{} {
+	if c.interned == nil {
+		return value
+	}
+	return c.interned.Intern(value)
+}
@@ -0,0 +1,116 @@
+package simplelru
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"testing"
+)
+
+func hashBlob(value interface{}) uint64 {
+	h := fnv.New64a()
+	h.Write(value.([]byte))
+	return h.Sum64()
+}
+
+func equalBlob(a interface{}, b interface{}) bool {
+	return bytes.Equal(a.([]byte), b.([]byte))
+}
+
+// sameBlob returns true if a and b share the same backing array
+func sameBlob(a interface{}, b interface{}) bool {
+	return &a.([]byte)[0] == &b.([]byte)[0]
+}
+
+func TestValueInterning(t *testing.T) {
+	cache := NewLRUCache(3, 1, WithValueInterning(hashBlob, equalBlob))
+	cache.Set("a", []byte("blob"))
+	cache.Set("b", []byte("blob"))
+	cache.Set("c", []byte("other"))
+
+	a, _ := cache.Peek("a")
+	b, _ := cache.Peek("b")
+	c, _ := cache.Peek("c")
+	if !sameBlob(a, b) {
+		t.Error("Identical values weren't shared")
+	}
+	if sameBlob(a, c) || string(c.([]byte)) != "other" {
+		t.Error("Different values were shared")
+	}
+	if n := cache.interned.Len(); n != 2 {
+		t.Error(fmt.Sprintf("Expected 2 distinct values, got %v", n))
+	}
+
+	// The shared value is kept until no key stores it
+	cache.Remove("a")
+	if n := cache.interned.Len(); n != 2 {
+		t.Error(fmt.Sprintf("Shared value dropped while still cached %v", n))
+	}
+	cache.Set("b", []byte("new"))
+	if n := cache.interned.Len(); n != 2 {
+		t.Error(fmt.Sprintf("Replaced value wasn't released %v", n))
+	}
+
+	// Values inserted later share the existing value, and evicted values
+	// are released
+	cache.Set("d", []byte("new"))
+	b, _ = cache.Peek("b")
+	d, _ := cache.Peek("d")
+	if !sameBlob(b, d) {
+		t.Error("Identical values weren't shared")
+	}
+	cache.Set("e", []byte("blob"))
+	if _, ok := cache.Peek("c"); ok {
+		t.Error("Oldest entry wasn't evicted")
+	}
+	if n := cache.interned.Len(); n != 2 {
+		t.Error(fmt.Sprintf("Evicted value wasn't released %v", n))
+	}
+
+	// Replacing a value with an identical one keeps it
+	cache.Set("e", []byte("blob"))
+	if value, _ := cache.Peek("e"); string(value.([]byte)) != "blob" {
+		t.Error(fmt.Sprintf("Unexpected value %v", value))
+	}
+
+	cache.Purge()
+	if n := cache.interned.Len(); n != 0 {
+		t.Error(fmt.Sprintf("Purge didn't reset the interned values %v", n))
+	}
+	cache.Set("a", []byte("blob"))
+	if n := cache.interned.Len(); n != 1 {
+		t.Error(fmt.Sprintf("Expected 1 distinct value, got %v", n))
+	}
+}
+
+func TestValueInterningCollisions(t *testing.T) {
+	constHash := func(value interface{}) uint64 { return 0 }
+	cache := NewLRUCache(10, 1, WithValueInterning(constHash, equalBlob))
+	for i := 0; i < 5; i++ {
+		cache.Set(i, []byte(fmt.Sprint(i%2)))
+	}
+	if n := cache.interned.Len(); n != 2 {
+		t.Error(fmt.Sprintf("Expected 2 distinct values, got %v", n))
+	}
+	for i := 0; i < 5; i++ {
+		value, _ := cache.Peek(i)
+		if string(value.([]byte)) != fmt.Sprint(i%2) {
+			t.Error(fmt.Sprintf("Unexpected value %v for key %v", value, i))
+		}
+	}
+	for i := 0; i < 5; i += 2 {
+		cache.Remove(i)
+	}
+	if n := cache.interned.Len(); n != 1 {
+		t.Error(fmt.Sprintf("Expected 1 distinct value, got %v", n))
+	}
+}
+
+func TestValueInterningRequiresFuncs(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Missing equal func didn't panic")
+		}
+	}()
+	NewLRUCache(10, 1, WithValueInterning(hashBlob, nil))
+}
@@ -0,0 +1,195 @@
+// Package intlru is a LRU cache specialized for int64 keys, avoiding the
+// allocations caused by boxing the keys into interface{} values.
+package intlru
+
+import (
+	"fmt"
+	"sync"
+)
+
+// An element of the cache, forms a linked list ordered by access time
+type node struct {
+	key   int64
+	value interface{}
+	next  *node
+	prev  *node
+}
+
+// IntLRUCache is a LRU cache with int64 keys
+type IntLRUCache struct {
+	// Embedded mutex
+	sync.Mutex
+
+	table map[int64]*node
+	root  node // List sentinel, root.next is the oldest node
+
+	// Free node linked list, and slice of allocated nodes
+	free *node
+	pool []node
+
+	// Max Size
+	size int
+
+	// Elements pruned everytime the cache if full
+	pruneSize int
+
+	// Hit miss stats
+	hitCount  uint64
+	missCount uint64
+}
+
+// NewIntLRUCache allocates an IntLRUCache
+func NewIntLRUCache(size int, pruneSize int) *IntLRUCache {
+	if size < 1 {
+		panic("NewIntLRUCache: min cache size is 1")
+	}
+	if pruneSize < 1 {
+		panic("NewIntLRUCache: min prune size is 1")
+	}
+
+	c := &IntLRUCache{
+		size:      size,
+		pruneSize: pruneSize,
+	}
+	c.init()
+	return c
+}
+
+// init allocates the table and node pool
+func (c *IntLRUCache) init() {
+	c.table = make(map[int64]*node, c.size)
+	c.root.next, c.root.prev = &c.root, &c.root
+	c.pool = make([]node, c.size)
+	c.free = nil
+	for n := range c.pool {
+		c.pool[n].next = c.free
+		c.free = &c.pool[n]
+	}
+}
+
+// unlink removes a node from the list
+func (c *IntLRUCache) unlink(n *node) {
+	n.next.prev = n.prev
+	n.prev.next = n.next
+}
+
+// pushLast inserts a node at the end of the list
+func (c *IntLRUCache) pushLast(n *node) {
+	n.next = &c.root
+	n.prev = c.root.prev
+	c.root.prev.next = n
+	c.root.prev = n
+}
+
+// delete removes a node from the cache and returns it to the free pool
+func (c *IntLRUCache) delete(n *node) {
+	c.unlink(n)
+	delete(c.table, n.key)
+	n.value = nil
+	n.prev = nil
+	n.next = c.free
+	c.free = n
+}
+
+// prune removes size elements from cache
+func (c *IntLRUCache) prune(size int) {
+	for x := size; x > 0 && len(c.table) > 0; x-- {
+		c.delete(c.root.next)
+	}
+}
+
+// Get a key value
+func (c *IntLRUCache) Get(key int64) (value interface{}, ok bool) {
+	c.Lock()
+	if n, found := c.table[key]; found {
+		c.hitCount++
+		c.unlink(n)
+		c.pushLast(n)
+		value, ok = n.value, true
+	} else {
+		c.missCount++
+	}
+	c.Unlock()
+	return
+}
+
+// Set or update key value, returns true if the cache was pruned to make space
+// for a new key.
+func (c *IntLRUCache) Set(key int64, value interface{}) (pruned bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if n, found := c.table[key]; found {
+		n.value = value
+		c.unlink(n)
+		c.pushLast(n)
+		return false
+	}
+
+	if len(c.table) >= c.size {
+		c.prune(c.pruneSize)
+		pruned = true
+	}
+
+	n := c.free
+	c.free = n.next
+	n.key, n.value = key, value
+	c.pushLast(n)
+	c.table[key] = n
+	return pruned
+}
+
+// Peek returns a key value without updating the cache or stats
+func (c *IntLRUCache) Peek(key int64) (value interface{}, ok bool) {
+	c.Lock()
+	if n, found := c.table[key]; found {
+		value, ok = n.value, true
+	}
+	c.Unlock()
+	return
+}
+
+// Contains returns true if the cache contains the key (no side-effects)
+func (c *IntLRUCache) Contains(key int64) bool {
+	_, ok := c.Peek(key)
+	return ok
+}
+
+// Remove key from cache
+func (c *IntLRUCache) Remove(key int64) {
+	c.Lock()
+	if n, found := c.table[key]; found {
+		c.delete(n)
+	}
+	c.Unlock()
+}
+
+// Len returns the number of cached items
+func (c *IntLRUCache) Len() (size int) {
+	c.Lock()
+	size = len(c.table)
+	c.Unlock()
+	return
+}
+
+// Purge all cache contents (without reseting stats)
+func (c *IntLRUCache) Purge() {
+	c.Lock()
+	c.init()
+	c.Unlock()
+}
+
+// Stats returns cache hit and miss stats
+func (c *IntLRUCache) Stats() (hit uint64, miss uint64) {
+	c.Lock()
+	hit, miss = c.hitCount, c.missCount
+	c.Unlock()
+	return
+}
+
+// Stringer interface
+func (c *IntLRUCache) String() string {
+	c.Lock()
+	defer c.Unlock()
+	return fmt.Sprintf("IntLRUCache(%v, %v)", c.size, len(c.table))
+}
@@ -0,0 +1,96 @@
+package intlru
+
+import (
+	"fmt"
+	"github.com/secnot/simplelru"
+	"testing"
+)
+
+func TestIntLRUCache(t *testing.T) {
+	cache := NewIntLRUCache(100, 10)
+	for i := int64(0); i < 100; i++ {
+		if pruned := cache.Set(i, i); pruned {
+			t.Error("Set pruned the cache before filling it")
+		}
+	}
+
+	if value, ok := cache.Get(0); !ok || value != int64(0) {
+		t.Error(fmt.Sprintf("Get(0) expected 0 received %v", value))
+	}
+
+	// Updating a key doesn't prune
+	cache.Set(50, "fifty")
+	if cache.Len() != 100 {
+		t.Error("Updating a key shouldn't prune the cache")
+	}
+
+	// 0 was refreshed so 1-10 are pruned
+	if pruned := cache.Set(1000, 1000); !pruned || cache.Len() != 91 {
+		t.Error("Set didn't prune the full cache")
+	}
+	for i := int64(1); i <= 10; i++ {
+		if cache.Contains(i) {
+			t.Error(fmt.Sprintf("%v should have been pruned", i))
+		}
+	}
+	if !cache.Contains(0) || !cache.Contains(1000) {
+		t.Error("Set pruned the newest keys")
+	}
+
+	if value, ok := cache.Peek(50); !ok || value != "fifty" {
+		t.Error("Set didn't update the key value")
+	}
+
+	cache.Remove(0)
+	if cache.Contains(0) {
+		t.Error("Remove didn't delete the key")
+	}
+
+	if _, ok := cache.Get(0); ok {
+		t.Error("Get returned a removed key")
+	}
+	if hit, miss := cache.Stats(); hit != 1 || miss != 1 {
+		t.Error("Stat accounting error")
+	}
+
+	cache.Purge()
+	if cache.Len() != 0 || cache.Contains(1000) {
+		t.Error("Purge didn't empty the cache")
+	}
+
+	// Size one cache
+	cache = NewIntLRUCache(1, 10)
+	cache.Set(1, 1)
+	cache.Set(2, 2)
+	if cache.Len() != 1 || !cache.Contains(2) {
+		t.Error("Size one cache failed")
+	}
+
+	if s := cache.String(); s != "IntLRUCache(1, 1)" {
+		t.Error("Unexpected String output ", s)
+	}
+}
+
+const benchKeys = 10000
+
+func BenchmarkIntLRUCache(b *testing.B) {
+	cache := NewIntLRUCache(benchKeys/2, 10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		key := int64(i*7919) % benchKeys
+		if _, ok := cache.Get(key); !ok {
+			cache.Set(key, nil)
+		}
+	}
+}
+
+func BenchmarkLRUCache(b *testing.B) {
+	cache := simplelru.NewLRUCache(benchKeys/2, 10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		key := int64(i*7919) % benchKeys
+		if _, ok := cache.Get(key); !ok {
+			cache.Set(key, nil)
+		}
+	}
+}
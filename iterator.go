@@ -0,0 +1,52 @@
+package simplelru
+
+import "github.com/secnot/simplelru/orderedmap"
+
+// Iterator walks the cache entries lazily, see LRUCache.Iterator
+type Iterator struct {
+	c   *LRUCache
+	om  *orderedmap.OrderedMap
+	it  *orderedmap.Iterator
+	err error
+}
+
+// Iterator returns an Iterator walking the entries from the least to the
+// most recently used, one entry per Next call, without copying them all like
+// ToMap. Iterating doesn't update the stats or the order of the entries, and
+// the values aren't copied (see WithValueClone).
+//
+// The cache is only locked during each Next call, so it can be used by other
+// goroutines while it is iterated, but it must not be modified meanwhile.
+// The iterator is fail-fast: once an entry is inserted, removed or moved
+// (by Set, Remove, evictions, Purge, or a Get making it the most recent),
+// Next returns ok false and Err returns ErrConcurrentModification, instead
+// of skipping or repeating entries. Use OldestN or ToMap for a consistent
+// snapshot of a cache in use.
+func (c *LRUCache) Iterator() *Iterator {
+	c.Lock()
+	defer c.Unlock()
+	return &Iterator{c: c, om: c.cache, it: c.cache.Iterator()}
+}
+
+// Next returns the next entry, ok is false when there are no more entries
+// or the cache was modified (see Err).
+func (it *Iterator) Next() (key interface{}, value interface{}, ok bool) {
+	if it.err != nil {
+		return nil, nil, false
+	}
+
+	it.c.Lock()
+	defer it.c.Unlock()
+	// Purge and SwapContents replace the map instead of modifying it
+	if it.c.cache != it.om || !it.it.Valid() {
+		it.err = ErrConcurrentModification
+		return nil, nil, false
+	}
+	return it.it.Next()
+}
+
+// Err returns ErrConcurrentModification if the iteration was interrupted
+// because the cache was modified, or nil.
+func (it *Iterator) Err() error {
+	return it.err
+}
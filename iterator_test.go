@@ -0,0 +1,84 @@
+package simplelru
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	for i := 0; i < 5; i++ {
+		cache.Set(i, i*10)
+	}
+	cache.Get(0)
+
+	// Walks from the least to the most recently used, without promoting
+	var keys []interface{}
+	it := cache.Iterator()
+	for {
+		key, value, ok := it.Next()
+		if !ok {
+			break
+		}
+		if value != key.(int)*10 {
+			t.Error(fmt.Sprintf("Unexpected value %v for key %v", value, key))
+		}
+		keys = append(keys, key)
+	}
+	if it.Err() != nil || fmt.Sprint(keys) != "[1 2 3 4 0]" {
+		t.Error(fmt.Sprintf("Unexpected iteration %v %v", keys, it.Err()))
+	}
+	if hits, _ := cache.Stats(); hits != 1 {
+		t.Error("Iterating updated the stats")
+	}
+
+	// Stopping early only walks the returned entries
+	it = cache.Iterator()
+	if key, _, ok := it.Next(); !ok || key != 1 {
+		t.Error(fmt.Sprintf("Unexpected first key %v", key))
+	}
+
+	// Empty cache
+	it = NewLRUCache(10, 1).Iterator()
+	if _, _, ok := it.Next(); ok || it.Err() != nil {
+		t.Error("Empty cache iterator returned an entry")
+	}
+}
+
+func TestIteratorModified(t *testing.T) {
+	modifications := map[string]func(c *LRUCache){
+		"Set":    func(c *LRUCache) { c.Set(10, 10) },
+		"Update": func(c *LRUCache) { c.Set(4, 40) },
+		"Remove": func(c *LRUCache) { c.Remove(4) },
+		"Get":    func(c *LRUCache) { c.Get(0) },
+		"Purge":  func(c *LRUCache) { c.Purge() },
+		"Swap":   func(c *LRUCache) { c.SwapContents([]Entry{{Key: 1, Value: 1}}) },
+	}
+	for name, modify := range modifications {
+		cache := NewLRUCache(10, 1)
+		for i := 0; i < 5; i++ {
+			cache.Set(i, i)
+		}
+		it := cache.Iterator()
+		it.Next()
+		modify(cache)
+		if _, _, ok := it.Next(); ok || it.Err() != ErrConcurrentModification {
+			t.Error(fmt.Sprintf("%v: modification wasn't detected %v", name, it.Err()))
+		}
+		if _, _, ok := it.Next(); ok {
+			t.Error(fmt.Sprintf("%v: iterator resumed after the modification", name))
+		}
+	}
+
+	// Lookups that don't promote the entries are allowed
+	cache := NewLRUCache(10, 1)
+	cache.Set(1, 1)
+	cache.Set(2, 2)
+	it := cache.Iterator()
+	it.Next()
+	cache.Peek(1)
+	cache.Contains(2)
+	if key, _, ok := it.Next(); !ok || key != 2 || it.Err() != nil {
+		t.Error(fmt.Sprintf("Lookup interrupted the iteration %v", it.Err()))
+	}
+}
@@ -4,4 +4,8 @@ import "errors"
 
 var (
 	ErrFull = errors.New("OrderedMap: Full")
+
+	// ErrConcurrentModification is the panic value of iterators used after
+	// the map was modified
+	ErrConcurrentModification = errors.New("OrderedMap: Concurrent modification")
 )
@@ -24,8 +24,15 @@ type OrderedMap struct {
 	// Free node linked list
 	free *node
 
-	// slice of allocated nodes
-	pool []node
+	// Number of allocated nodes (used and free)
+	capacity int
+
+	// Called when the capacity grows (optional)
+	onGrow func(oldCap, newCap int)
+
+	// Incremented on every change to the list, so iterators can detect the
+	// map was modified while iterating
+	version uint64
 }
 
 // NewOrderedMap creates an empty OrderedMap, allocating size initial nodes
@@ -33,23 +40,45 @@ func NewOrderedMap(size int) *OrderedMap {
 	root := &node{nil, nil, nil, nil} // sentinel Node
 	root.Next, root.Prev = root, root
 
-	pool := make([]node, size, size)
-
 	//
 	om := &OrderedMap{
 		table: make(map[interface{}]*node),
 		root:  root,
-		pool:  pool,
 		free:  nil,
 	}
+	om.allocNodes(size)
+
+	return om
+}
+
+// allocNodes allocates a pool of size nodes and adds them to the free list
+func (om *OrderedMap) allocNodes(size int) {
+	pool := make([]node, size, size)
 
 	// Add pool nodes to free linked list
 	for n, _ := range pool {
 		pool[n].Next = om.free
 		om.free = &pool[n]
 	}
+	om.capacity += size
+}
 
-	return om
+// Reserve grows the map capacity to at least size elements, allocating the
+// missing nodes. It never shrinks the map.
+func (om *OrderedMap) Reserve(size int) {
+	if size > om.capacity {
+		oldCap := om.capacity
+		om.allocNodes(size - om.capacity)
+		if om.onGrow != nil {
+			om.onGrow(oldCap, om.capacity)
+		}
+	}
+}
+
+// SetOnGrow sets a function called with the old and new capacity each time
+// the map capacity grows, useful to tune the initial capacity.
+func (om *OrderedMap) SetOnGrow(onGrow func(oldCap, newCap int)) {
+	om.onGrow = onGrow
 }
 
 // Len returns the number of elements in the Map
@@ -59,7 +88,7 @@ func (om *OrderedMap) Len() int {
 
 // Cap returns the map capacity
 func (om *OrderedMap) Cap() int {
-	return len(om.pool)
+	return om.capacity
 }
 
 // getNode a node from free pool
@@ -71,6 +100,7 @@ func (om *OrderedMap) getNode(key interface{}, value interface{},
 
 	n = om.free
 	om.free = om.free.Next
+	om.version++
 
 	n.Next = next
 	n.Prev = prev
@@ -81,6 +111,7 @@ func (om *OrderedMap) getNode(key interface{}, value interface{},
 
 // freeNode returns a node to the free pool
 func (om *OrderedMap) freeNode(n *node) {
+	om.version++
 	n.Key = nil
 	n.Value = nil
 	n.Prev = nil
@@ -107,6 +138,35 @@ func (om *OrderedMap) Set(key interface{}, value interface{}) (err error) {
 	return err
 }
 
+// Update sets the value of an existing key without changing its position,
+// returns false if the key isn't in the map.
+func (om *OrderedMap) Update(key interface{}, value interface{}) bool {
+	nd, ok := om.table[key]
+	if ok {
+		nd.Value = value
+	}
+	return ok
+}
+
+// GetOrSet returns the value of key and loaded true if it is in the map,
+// otherwise it inserts key:value at the end and returns value. The key is
+// only looked up once. Returns ErrFull if the key couldn't be inserted.
+func (om *OrderedMap) GetOrSet(key interface{}, value interface{}) (actual interface{}, loaded bool, err error) {
+	if nd, ok := om.table[key]; ok {
+		return nd.Value, true, nil
+	}
+
+	root := om.root
+	nd, err := om.getNode(key, value, root, root.Prev)
+	if err != nil {
+		return nil, false, err
+	}
+	root.Prev.Next = nd
+	root.Prev = nd
+	om.table[key] = nd
+	return value, false, nil
+}
+
 // Get the value of an existing key, leaving the map unchanged
 func (om *OrderedMap) Get(key interface{}) (value interface{}, ok bool) {
 	if node, isOk := om.table[key]; !isOk {
@@ -151,6 +211,24 @@ func (om *OrderedMap) Delete(key interface{}) {
 	}
 }
 
+// DeleteMulti deletes a batch of keys from the map, and returns the number
+// of keys actually deleted.
+func (om *OrderedMap) DeleteMulti(keys []interface{}) (deleted int) {
+	for _, key := range keys {
+		node, ok := om.table[key]
+		if !ok {
+			continue
+		}
+		node.Next.Prev = node.Prev
+		node.Prev.Next = node.Next
+
+		delete(om.table, key)
+		om.freeNode(node)
+		deleted++
+	}
+	return deleted
+}
+
 // Pop and return key:value for the newest or oldest element on the OrderedMap
 func (om *OrderedMap) Pop(last bool) (key interface{}, value interface{}, ok bool) {
 	if last {
@@ -189,6 +267,7 @@ func (om *OrderedMap) Move(key interface{}, last bool) (ok bool) {
 	anode.Next.Prev = anode.Prev
 	anode.Prev.Next = anode.Next
 	moved = anode
+	om.version++
 
 	// Insert at the start or end
 	root := om.root
@@ -207,6 +286,31 @@ func (om *OrderedMap) Move(key interface{}, last bool) (ok bool) {
 	return true
 }
 
+// MoveOrInsert moves an existing key to the end (last true) or beginning of
+// the map leaving its value unchanged, or inserts the key:value there if it
+// isn't in the map. Returns true if the key was inserted, and ErrFull if it
+// couldn't be inserted because the map is full.
+func (om *OrderedMap) MoveOrInsert(key interface{}, value interface{}, last bool) (inserted bool, err error) {
+	if om.Move(key, last) {
+		return false, nil
+	}
+
+	root := om.root
+	var nd *node
+	if last {
+		nd, err = om.getNode(key, value, root, root.Prev)
+	} else {
+		nd, err = om.getNode(key, value, root.Next, root)
+	}
+	if err != nil {
+		return false, err
+	}
+	nd.Prev.Next = nd
+	nd.Next.Prev = nd
+	om.table[key] = nd
+	return true, nil
+}
+
 // MoveLast is a shortcut to Move a key to the end o the map
 func (om *OrderedMap) MoveLast(key interface{}) (ok bool) {
 	return om.Move(key, true)
@@ -217,6 +321,189 @@ func (om *OrderedMap) MoveFirst(key interface{}) (ok bool) {
 	return om.Move(key, false)
 }
 
+// At returns the key and value of the element at position index in the map
+// order, negative indices count from the end (-1 is the last element). It
+// walks the list from the closest end so it is O(n).
+func (om *OrderedMap) At(index int) (key interface{}, value interface{}, ok bool) {
+	length := len(om.table)
+	if index < 0 {
+		index += length
+	}
+	if index < 0 || index >= length {
+		return nil, nil, false
+	}
+
+	var n *node
+	if index < length/2 {
+		n = om.root.Next
+		for i := 0; i < index; i++ {
+			n = n.Next
+		}
+	} else {
+		n = om.root.Prev
+		for i := length - 1; i > index; i-- {
+			n = n.Prev
+		}
+	}
+	return n.Key, n.Value, true
+}
+
+// Compact reallocates all the nodes in a single pool, in the same order as
+// the map, so walking the map (Keys, Iterator) reads memory sequentially
+// instead of jumping between scattered nodes. After many moves and deletes
+// the node order in memory is random, Compact restores the locality at the
+// cost of a full copy. Iterators created before Compact are invalidated.
+func (om *OrderedMap) Compact() {
+	pool := make([]node, om.capacity, om.capacity)
+	om.version++
+
+	root := om.root
+	used := 0
+	for n := root.Next; n != root; n = n.Next {
+		pool[used].Key, pool[used].Value = n.Key, n.Value
+		used++
+	}
+
+	// Link used nodes in pool order
+	prev := root
+	for i := 0; i < used; i++ {
+		nd := &pool[i]
+		nd.Prev = prev
+		prev.Next = nd
+		om.table[nd.Key] = nd
+		prev = nd
+	}
+	prev.Next = root
+	root.Prev = prev
+
+	// The rest are free
+	om.free = nil
+	for i := len(pool) - 1; i >= used; i-- {
+		pool[i].Next = om.free
+		om.free = &pool[i]
+	}
+}
+
+// Keys returns a slice with all the keys, from the oldest to the newest
+func (om *OrderedMap) Keys() []interface{} {
+	keys := make([]interface{}, 0, len(om.table))
+	for n := om.root.Next; n != om.root; n = n.Next {
+		keys = append(keys, n.Key)
+	}
+	return keys
+}
+
+// Iterator walks an OrderedMap lazily from the oldest to the newest element,
+// or the other way for reverse iterators. The map must not be modified while
+// it is being iterated, iterators are fail-fast and Next panics with
+// ErrConcurrentModification if an element was inserted, deleted or moved
+// since the iterator was created. Updating the values is allowed.
+type Iterator struct {
+	om      *OrderedMap
+	next    *node
+	reverse bool
+	version uint64
+}
+
+// Iterator returns an Iterator positioned before the first element
+func (om *OrderedMap) Iterator() *Iterator {
+	return &Iterator{om: om, next: om.root.Next, version: om.version}
+}
+
+// ReverseIterator returns an Iterator walking from the last to the first
+// element
+func (om *OrderedMap) ReverseIterator() *Iterator {
+	return &Iterator{om: om, next: om.root.Prev, reverse: true, version: om.version}
+}
+
+// Valid returns false if the map was modified since the iterator was created,
+// and Next would panic.
+func (it *Iterator) Valid() bool {
+	return it.om.version == it.version
+}
+
+// Next returns the next element, ok is false when there are no more elements
+func (it *Iterator) Next() (key interface{}, value interface{}, ok bool) {
+	if it.om.version != it.version {
+		panic(ErrConcurrentModification)
+	}
+	if it.next == it.om.root {
+		return nil, nil, false
+	}
+	n := it.next
+	if it.reverse {
+		it.next = n.Prev
+	} else {
+		it.next = n.Next
+	}
+	return n.Key, n.Value, true
+}
+
+// Range calls f for each key and value from the oldest to the newest
+// element, stopping when f returns false. The map must not be modified by f,
+// like Iterator it panics with ErrConcurrentModification if it is.
+func (om *OrderedMap) Range(f func(key, value interface{}) bool) {
+	it := om.Iterator()
+	for {
+		key, value, ok := it.Next()
+		if !ok || !f(key, value) {
+			return
+		}
+	}
+}
+
+// RangeReverse is the same as Range but walks from the newest to the
+// oldest element.
+func (om *OrderedMap) RangeReverse(f func(key, value interface{}) bool) {
+	it := om.ReverseIterator()
+	for {
+		key, value, ok := it.Next()
+		if !ok || !f(key, value) {
+			return
+		}
+	}
+}
+
+// Validate checks the internal consistency of the map, the linked list is
+// circular through the root, every list node is in the table and every table
+// entry in the list, and all the nodes are either used or free. Returns an
+// error describing the first inconsistency found.
+func (om *OrderedMap) Validate() error {
+	count := 0
+	for n := om.root.Next; n != om.root; n = n.Next {
+		if n == nil {
+			return fmt.Errorf("OrderedMap: list broken after %v nodes", count)
+		}
+		if n.Next == nil || n.Next.Prev != n {
+			return fmt.Errorf("OrderedMap: %v next node doesn't link back", n)
+		}
+		if tn, ok := om.table[n.Key]; !ok || tn != n {
+			return fmt.Errorf("OrderedMap: %v is not in the table", n)
+		}
+		if count++; count > len(om.table) {
+			return fmt.Errorf("OrderedMap: list is longer than the table (%v)", len(om.table))
+		}
+	}
+	if om.root.Next.Prev != om.root {
+		return fmt.Errorf("OrderedMap: first node doesn't link back to root")
+	}
+	if count != len(om.table) {
+		return fmt.Errorf("OrderedMap: %v table entries not in the list", len(om.table)-count)
+	}
+
+	free := 0
+	for n := om.free; n != nil; n = n.Next {
+		if free++; free > om.Cap() {
+			return fmt.Errorf("OrderedMap: free list has a cycle")
+		}
+	}
+	if count+free != om.Cap() {
+		return fmt.Errorf("OrderedMap: %v used + %v free nodes don't match capacity %v",
+			count, free, om.Cap())
+	}
+	return nil
+}
+
 // String interface
 func (om *OrderedMap) String() string {
 	return fmt.Sprintf("OrderedMap(len: %v)", len(om.table))
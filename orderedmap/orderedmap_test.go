@@ -379,3 +379,572 @@ func TestMapSize(t *testing.T) {
 		t.Error("Expected a full map")
 	}
 }
+
+func TestKeys(t *testing.T) {
+	om := NewOrderedMap(10)
+	if keys := om.Keys(); len(keys) != 0 {
+		t.Error("Keys of an empty map should be empty")
+	}
+
+	om.Set("one", 1)
+	om.Set("two", 2)
+	om.Set("three", 3)
+	om.MoveFirst("three")
+	om.Delete("one")
+
+	keys := om.Keys()
+	if len(keys) != 2 || keys[0] != "three" || keys[1] != "two" {
+		t.Error(fmt.Sprintf("Unexpected keys %v", keys))
+	}
+}
+
+func TestDeleteMulti(t *testing.T) {
+	om := NewOrderedMap(10)
+	for i := 0; i < 10; i++ {
+		om.Set(i, i)
+	}
+
+	// Missing and duplicated keys are not counted
+	if deleted := om.DeleteMulti([]interface{}{1, 3, 5, 3, 100}); deleted != 3 {
+		t.Error(fmt.Sprintf("DeleteMulti returned %v expected 3", deleted))
+	}
+
+	keys := om.Keys()
+	if fmt.Sprint(keys) != "[0 2 4 6 7 8 9]" {
+		t.Error(fmt.Sprintf("Unexpected keys after DeleteMulti %v", keys))
+	}
+
+	// Freed nodes are returned to the pool
+	for i := 10; i < 13; i++ {
+		if err := om.Set(i, i); err != nil {
+			t.Error("DeleteMulti didn't return the nodes to the free pool")
+		}
+	}
+	if err := om.Set(13, 13); err != ErrFull {
+		t.Error("The map should be full")
+	}
+}
+
+func BenchmarkDelete(b *testing.B) {
+	keys := make([]interface{}, 1000)
+	for i := range keys {
+		keys[i] = i
+	}
+	om := NewOrderedMap(len(keys))
+	for i := 0; i < b.N; i++ {
+		for _, key := range keys {
+			om.Set(key, key)
+		}
+		for _, key := range keys {
+			om.Delete(key)
+		}
+	}
+}
+
+func BenchmarkDeleteMulti(b *testing.B) {
+	keys := make([]interface{}, 1000)
+	for i := range keys {
+		keys[i] = i
+	}
+	om := NewOrderedMap(len(keys))
+	for i := 0; i < b.N; i++ {
+		for _, key := range keys {
+			om.Set(key, key)
+		}
+		om.DeleteMulti(keys)
+	}
+}
+
+func TestAt(t *testing.T) {
+	om := NewOrderedMap(10)
+	if key, value, ok := om.At(0); key != nil || value != nil || ok {
+		t.Error("At returned an element from an empty map")
+	}
+
+	for i := 0; i < 5; i++ {
+		om.Set(i, i*10)
+	}
+	om.MoveLast(0)
+
+	// Order: 1 2 3 4 0
+	expected := []interface{}{1, 2, 3, 4, 0}
+	for i, key := range expected {
+		if k, v, ok := om.At(i); k != key || v != key.(int)*10 || !ok {
+			t.Error(fmt.Sprintf("At(%v) -> %v %v %v", i, k, v, ok))
+		}
+		if k, _, ok := om.At(i - 5); k != key || !ok {
+			t.Error(fmt.Sprintf("At(%v) -> %v", i-5, k))
+		}
+	}
+
+	if _, _, ok := om.At(5); ok {
+		t.Error("At returned an element past the end")
+	}
+	if _, _, ok := om.At(-6); ok {
+		t.Error("At returned an element before the start")
+	}
+}
+
+func TestIterator(t *testing.T) {
+	om := NewOrderedMap(10)
+	if _, _, ok := om.Iterator().Next(); ok {
+		t.Error("Iterator of an empty map returned an element")
+	}
+
+	for i := 0; i < 5; i++ {
+		om.Set(i, i*10)
+	}
+	om.MoveFirst(4)
+
+	it := om.Iterator()
+	expected := []int{4, 0, 1, 2, 3}
+	for _, key := range expected {
+		if k, v, ok := it.Next(); k != key || v != key*10 || !ok {
+			t.Error(fmt.Sprintf("Iterator expected %v received %v %v %v", key, k, v, ok))
+		}
+	}
+
+	// Exhausted iterators keep returning false
+	for i := 0; i < 2; i++ {
+		if k, v, ok := it.Next(); k != nil || v != nil || ok {
+			t.Error("Exhausted iterator returned an element")
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	om := NewOrderedMap(10)
+	if err := om.Validate(); err != nil {
+		t.Error("Unexpected error for empty map: ", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		om.Set(i, i)
+	}
+	om.MoveFirst(5)
+	om.Delete(3)
+	om.PopLast()
+	if err := om.Validate(); err != nil {
+		t.Error("Unexpected error: ", err)
+	}
+
+	// Broken back link
+	om.table[4].Prev = om.root
+	if err := om.Validate(); err == nil {
+		t.Error("Validate didn't detect a broken back link")
+	}
+
+	// Node missing from the table
+	om = NewOrderedMap(10)
+	om.Set(1, 1)
+	om.Set(2, 2)
+	delete(om.table, 2)
+	if err := om.Validate(); err == nil {
+		t.Error("Validate didn't detect a node missing from the table")
+	}
+
+	// Lost node
+	om = NewOrderedMap(10)
+	om.Set(1, 1)
+	om.free = om.free.Next
+	if err := om.Validate(); err == nil {
+		t.Error("Validate didn't detect a lost free node")
+	}
+}
+
+func TestReserve(t *testing.T) {
+	om := NewOrderedMap(2)
+	om.Set(1, 1)
+	om.Set(2, 2)
+	if err := om.Set(3, 3); err != ErrFull {
+		t.Error("The map should be full")
+	}
+
+	om.Reserve(1) // Never shrinks
+	if om.Cap() != 2 {
+		t.Error("Reserve shrunk the map")
+	}
+
+	om.Reserve(4)
+	if om.Cap() != 4 {
+		t.Error(fmt.Sprintf("Reserve(4) capacity is %v", om.Cap()))
+	}
+	for i := 3; i <= 4; i++ {
+		if err := om.Set(i, i); err != nil {
+			t.Error("Set failed after Reserve: ", err)
+		}
+	}
+	if err := om.Set(5, 5); err != ErrFull {
+		t.Error("The map should be full")
+	}
+
+	if fmt.Sprint(om.Keys()) != "[1 2 3 4]" {
+		t.Error("Reserve modified the map order")
+	}
+	if err := om.Validate(); err != nil {
+		t.Error("Invalid map after Reserve: ", err)
+	}
+}
+
+func TestMoveOrInsert(t *testing.T) {
+	om := NewOrderedMap(4)
+	om.Set(1, 1)
+	om.Set(2, 2)
+
+	// Insert at both ends
+	if inserted, err := om.MoveOrInsert(3, 3, true); !inserted || err != nil {
+		t.Error("MoveOrInsert didn't insert the last key")
+	}
+	if inserted, err := om.MoveOrInsert(0, 0, false); !inserted || err != nil {
+		t.Error("MoveOrInsert didn't insert the first key")
+	}
+	if fmt.Sprint(om.Keys()) != "[0 1 2 3]" {
+		t.Error(fmt.Sprintf("Unexpected order %v", om.Keys()))
+	}
+
+	// Move existing keys, the value is unchanged
+	if inserted, err := om.MoveOrInsert(1, 100, true); inserted || err != nil {
+		t.Error("MoveOrInsert inserted an existing key")
+	}
+	if inserted, _ := om.MoveOrInsert(3, 300, false); inserted {
+		t.Error("MoveOrInsert inserted an existing key")
+	}
+	if fmt.Sprint(om.Keys()) != "[3 0 2 1]" {
+		t.Error(fmt.Sprintf("Unexpected order %v", om.Keys()))
+	}
+	if v, _ := om.Get(1); v != 1 {
+		t.Error("MoveOrInsert modified an existing value")
+	}
+
+	// Full map
+	if _, err := om.MoveOrInsert(5, 5, true); err != ErrFull {
+		t.Error("MoveOrInsert should return ErrFull")
+	}
+	if err := om.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	om := NewOrderedMap(2)
+	om.Set(1, "one")
+
+	if actual, loaded, err := om.GetOrSet(1, "uno"); actual != "one" || !loaded || err != nil {
+		t.Error("GetOrSet didn't return the existing value")
+	}
+	if actual, loaded, err := om.GetOrSet(2, "two"); actual != "two" || loaded || err != nil {
+		t.Error("GetOrSet didn't insert the new value")
+	}
+	if v, _ := om.Get(2); v != "two" || fmt.Sprint(om.Keys()) != "[1 2]" {
+		t.Error("GetOrSet didn't insert the key at the end")
+	}
+
+	if _, loaded, err := om.GetOrSet(3, "three"); loaded || err != ErrFull {
+		t.Error("GetOrSet should return ErrFull")
+	}
+	if actual, loaded, err := om.GetOrSet(1, "uno"); actual != "one" || !loaded || err != nil {
+		t.Error("GetOrSet should load existing keys when full")
+	}
+}
+
+func TestOnGrow(t *testing.T) {
+	om := NewOrderedMap(2)
+	var grows []string
+	om.SetOnGrow(func(oldCap, newCap int) {
+		grows = append(grows, fmt.Sprintf("%v->%v", oldCap, newCap))
+	})
+
+	om.Reserve(2) // No growth
+	om.Reserve(4)
+	om.Reserve(3)
+	om.Reserve(10)
+	if fmt.Sprint(grows) != "[2->4 4->10]" {
+		t.Error(fmt.Sprintf("Unexpected grow calls %v", grows))
+	}
+}
+
+func TestCompact(t *testing.T) {
+	om := NewOrderedMap(10)
+	for i := 0; i < 8; i++ {
+		om.Set(i, i*10)
+	}
+	om.Delete(3)
+	om.MoveFirst(5)
+	om.MoveLast(0)
+	om.Reserve(12)
+	expected := fmt.Sprint(om.Keys())
+
+	om.Compact()
+	if fmt.Sprint(om.Keys()) != expected {
+		t.Error(fmt.Sprintf("Compact changed the order %v expecting %v", om.Keys(), expected))
+	}
+	if v, _ := om.Get(5); v != 50 {
+		t.Error("Compact lost a value")
+	}
+	if om.Cap() != 12 || om.Len() != 7 {
+		t.Error("Compact changed the map size")
+	}
+	if err := om.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// The map keeps working
+	for i := 10; i < 15; i++ {
+		if err := om.Set(i, i); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := om.Set(15, 15); err != ErrFull {
+		t.Error("The compacted map should be full")
+	}
+
+	empty := NewOrderedMap(3)
+	empty.Compact()
+	if err := empty.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+// scatteredMap returns a map whose nodes order in memory is shuffled
+func scatteredMap(size int) *OrderedMap {
+	om := NewOrderedMap(size)
+	for i := 0; i < size; i++ {
+		om.Set(i, i)
+	}
+	// Deterministic shuffle moving keys around
+	for i := 0; i < size; i++ {
+		om.MoveLast((i * 7919) % size)
+	}
+	return om
+}
+
+func benchmarkIterate(b *testing.B, om *OrderedMap) {
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := om.Iterator()
+		for _, _, ok := it.Next(); ok; _, _, ok = it.Next() {
+		}
+	}
+}
+
+func BenchmarkIterateScattered(b *testing.B) {
+	benchmarkIterate(b, scatteredMap(1<<18))
+}
+
+func BenchmarkIterateCompact(b *testing.B) {
+	om := scatteredMap(1 << 18)
+	om.Compact()
+	benchmarkIterate(b, om)
+}
+
+func TestReverseIterator(t *testing.T) {
+	om := NewOrderedMap(10)
+	if _, _, ok := om.ReverseIterator().Next(); ok {
+		t.Error("Empty map iterator returned an element")
+	}
+
+	for i := 0; i < 5; i++ {
+		om.Set(i, i*10)
+	}
+	var keys []interface{}
+	it := om.ReverseIterator()
+	for key, value, ok := it.Next(); ok; key, value, ok = it.Next() {
+		if value != key.(int)*10 {
+			t.Error("Iterator returned the wrong value")
+		}
+		keys = append(keys, key)
+	}
+	if fmt.Sprint(keys) != "[4 3 2 1 0]" {
+		t.Error(fmt.Sprintf("Unexpected reverse order %v", keys))
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	om := NewOrderedMap(5)
+	om.Set(1, "one")
+	om.Set(2, "two")
+
+	if !om.Update(1, "uno") {
+		t.Error("Update failed for an existing key")
+	}
+	if v, _ := om.Get(1); v != "uno" {
+		t.Error("Update didn't set the value")
+	}
+	if fmt.Sprint(om.Keys()) != "[1 2]" {
+		t.Error("Update moved the key")
+	}
+
+	if om.Update(3, "three") || om.Len() != 2 {
+		t.Error("Update inserted a missing key")
+	}
+}
+
+// rangeKeys returns the keys visited by Range or RangeReverse
+func rangeKeys(rangeFunc func(func(key, value interface{}) bool)) []interface{} {
+	var keys []interface{}
+	rangeFunc(func(key, value interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func TestRange(t *testing.T) {
+	om := NewOrderedMap(10)
+	if keys := rangeKeys(om.Range); len(keys) != 0 {
+		t.Error("Range visited an empty map element")
+	}
+	if keys := rangeKeys(om.RangeReverse); len(keys) != 0 {
+		t.Error("RangeReverse visited an empty map element")
+	}
+
+	for i := 0; i < 5; i++ {
+		om.Set(i, i*10)
+	}
+	om.Range(func(key, value interface{}) bool {
+		if value != key.(int)*10 {
+			t.Error("Range returned the wrong value")
+		}
+		return true
+	})
+	if keys := rangeKeys(om.Range); fmt.Sprint(keys) != "[0 1 2 3 4]" {
+		t.Error(fmt.Sprintf("Unexpected Range order %v", keys))
+	}
+	if keys := rangeKeys(om.RangeReverse); fmt.Sprint(keys) != "[4 3 2 1 0]" {
+		t.Error(fmt.Sprintf("Unexpected RangeReverse order %v", keys))
+	}
+
+	// Returning false stops the iteration
+	var keys []interface{}
+	om.RangeReverse(func(key, value interface{}) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	})
+	if fmt.Sprint(keys) != "[4 3]" {
+		t.Error(fmt.Sprintf("RangeReverse didn't stop %v", keys))
+	}
+}
+
+// Test the iteration order guarantees: new keys are appended, updating an
+// existing key keeps its position, and a deleted key is appended again when
+// it's set back.
+func TestIterationOrder(t *testing.T) {
+	om := NewOrderedMap(10)
+	om.Set("a", 1)
+	om.Set("b", 2)
+	om.Set("c", 3)
+
+	// Updates don't move
+	om.Set("a", 10)
+	om.Update("b", 20)
+	if v, _, _ := om.GetOrSet("c", 30); v != 3 {
+		t.Error("GetOrSet overwrote an existing key")
+	}
+	if fmt.Sprint(om.Keys()) != "[a b c]" {
+		t.Error(fmt.Sprintf("Updates changed the order %v", om.Keys()))
+	}
+
+	// Inserts are appended
+	om.Set("d", 4)
+	om.GetOrSet("e", 5)
+	if fmt.Sprint(om.Keys()) != "[a b c d e]" {
+		t.Error(fmt.Sprintf("Inserts weren't appended %v", om.Keys()))
+	}
+
+	// Deleted keys lose their position
+	om.Delete("a")
+	om.Set("a", 1)
+	if fmt.Sprint(om.Keys()) != "[b c d e a]" {
+		t.Error(fmt.Sprintf("Reinserted key wasn't appended %v", om.Keys()))
+	}
+
+	// All the walks agree
+	forward := fmt.Sprint(rangeKeys(om.Range))
+	reverse := rangeKeys(om.RangeReverse)
+	for i, j := 0, len(reverse)-1; i < j; i, j = i+1, j-1 {
+		reverse[i], reverse[j] = reverse[j], reverse[i]
+	}
+	var iterated []interface{}
+	it := om.Iterator()
+	for key, _, ok := it.Next(); ok; key, _, ok = it.Next() {
+		iterated = append(iterated, key)
+	}
+	if forward != fmt.Sprint(om.Keys()) || forward != fmt.Sprint(reverse) ||
+		forward != fmt.Sprint(iterated) {
+		t.Error(fmt.Sprintf("Walks disagree %v %v %v", forward, reverse, iterated))
+	}
+	if err := om.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+// expectModificationPanic checks fn panics with ErrConcurrentModification
+func expectModificationPanic(t *testing.T, name string, fn func()) {
+	defer func() {
+		if r := recover(); r != ErrConcurrentModification {
+			t.Error(fmt.Sprintf("%v: expected concurrent modification panic, got %v", name, r))
+		}
+	}()
+	fn()
+}
+
+func TestIteratorFailFast(t *testing.T) {
+	newMap := func() *OrderedMap {
+		om := NewOrderedMap(10)
+		for i := 0; i < 5; i++ {
+			om.Set(i, i)
+		}
+		return om
+	}
+
+	modifications := map[string]func(om *OrderedMap){
+		"Set":          func(om *OrderedMap) { om.Set(10, 10) },
+		"GetOrSet":     func(om *OrderedMap) { om.GetOrSet(10, 10) },
+		"Delete":       func(om *OrderedMap) { om.Delete(4) },
+		"DeleteMulti":  func(om *OrderedMap) { om.DeleteMulti([]interface{}{4}) },
+		"Pop":          func(om *OrderedMap) { om.PopFirst() },
+		"Move":         func(om *OrderedMap) { om.MoveFirst(4) },
+		"MoveOrInsert": func(om *OrderedMap) { om.MoveOrInsert(10, 10, true) },
+		"Compact":      func(om *OrderedMap) { om.Compact() },
+	}
+	for name, modify := range modifications {
+		om := newMap()
+		it := om.Iterator()
+		it.Next()
+		if !it.Valid() {
+			t.Error(name + ": iterator invalid before the modification")
+		}
+		modify(om)
+		if it.Valid() {
+			t.Error(name + ": iterator still valid after the modification")
+		}
+		expectModificationPanic(t, name, func() { it.Next() })
+
+		om = newMap()
+		expectModificationPanic(t, name+" in Range", func() {
+			om.Range(func(key, value interface{}) bool {
+				modify(om)
+				return true
+			})
+		})
+	}
+
+	// Value updates, lookups and failed changes don't invalidate iterators
+	om := newMap()
+	it := om.ReverseIterator()
+	it.Next()
+	om.Set(1, 100)
+	om.Update(2, 200)
+	om.Get(3)
+	om.GetOrSet(1, 0)
+	om.Delete(20)
+	om.Move(20, true)
+	om.Reserve(20)
+	count := 1
+	for _, _, ok := it.Next(); ok; _, _, ok = it.Next() {
+		count++
+	}
+	if count != 5 {
+		t.Error(fmt.Sprintf("Iterator returned %v elements expecting 5", count))
+	}
+}
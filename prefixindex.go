@@ -0,0 +1,77 @@
+package simplelru
+
+// prefixIndex is a byte trie with all the cached string keys, used to find
+// the keys sharing a prefix without scanning the whole cache.
+type prefixIndex struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	children map[byte]*trieNode
+	isKey    bool // A cached key ends at this node
+}
+
+func newPrefixIndex() *prefixIndex {
+	return &prefixIndex{root: &trieNode{}}
+}
+
+// Add key to the index
+func (p *prefixIndex) Add(key string) {
+	n := p.root
+	for i := 0; i < len(key); i++ {
+		child, ok := n.children[key[i]]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[byte]*trieNode)
+			}
+			child = &trieNode{}
+			n.children[key[i]] = child
+		}
+		n = child
+	}
+	n.isKey = true
+}
+
+// Remove key from the index, pruning the branches left empty
+func (p *prefixIndex) Remove(key string) {
+	path := make([]*trieNode, 0, len(key)+1)
+	n := p.root
+	for i := 0; i < len(key); i++ {
+		path = append(path, n)
+		if n = n.children[key[i]]; n == nil {
+			return // Not indexed
+		}
+	}
+	n.isKey = false
+
+	// Walk back deleting nodes without keys or children
+	for i := len(key) - 1; i >= 0; i-- {
+		if n.isKey || len(n.children) > 0 {
+			break
+		}
+		n = path[i]
+		delete(n.children, key[i])
+	}
+}
+
+// Match returns all the indexed keys starting with prefix
+func (p *prefixIndex) Match(prefix string) (keys []string) {
+	n := p.root
+	for i := 0; i < len(prefix); i++ {
+		if n = n.children[prefix[i]]; n == nil {
+			return nil
+		}
+	}
+
+	var collect func(n *trieNode, key []byte)
+	collect = func(n *trieNode, key []byte) {
+		if n.isKey {
+			keys = append(keys, string(key))
+		}
+		for b, child := range n.children {
+			collect(child, append(key, b))
+		}
+	}
+	collect(n, []byte(prefix))
+	return keys
+}
@@ -0,0 +1,113 @@
+package simplelru
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestPrefixIndex(t *testing.T) {
+	index := newPrefixIndex()
+	index.Add("/a")
+	index.Add("/a/b")
+	index.Add("/a/c")
+	index.Add("/b")
+	index.Add("")
+
+	matches := index.Match("/a")
+	sort.Strings(matches)
+	if fmt.Sprint(matches) != "[/a /a/b /a/c]" {
+		t.Error(fmt.Sprintf("Unexpected prefix matches %v", matches))
+	}
+
+	if matches := index.Match("/c"); len(matches) != 0 {
+		t.Error("Matched a prefix that isn't indexed")
+	}
+
+	if matches := index.Match(""); len(matches) != 5 {
+		t.Error("The empty prefix should match every key")
+	}
+
+	// Removing a key doesn't remove the keys below it
+	index.Remove("/a")
+	index.Remove("/a/c")
+	index.Remove("/not/indexed")
+	if matches := index.Match("/a"); len(matches) != 1 || matches[0] != "/a/b" {
+		t.Error(fmt.Sprintf("Unexpected prefix matches after Remove %v", matches))
+	}
+
+	// Empty branches are pruned
+	index.Remove("/a/b")
+	if _, ok := index.root.children['/'].children['a']; ok {
+		t.Error("Remove didn't prune the empty branch")
+	}
+}
+
+func TestRemovePrefix(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		var cache *LRUCache
+		if indexed {
+			cache = NewLRUCache(100, 10, WithPrefixIndex())
+		} else {
+			cache = NewLRUCache(100, 10)
+		}
+
+		cache.Set("/user/1", 1)
+		cache.Set("/user/2", 2)
+		cache.Set("/users", 3)
+		cache.Set("/group/1", 4)
+		cache.Set(5, 5)
+
+		if n := cache.RemovePrefix("/user/"); n != 2 {
+			t.Error(fmt.Sprintf("RemovePrefix removed %v keys, expected 2", n))
+		}
+		if cache.Contains("/user/1") || cache.Contains("/user/2") {
+			t.Error("RemovePrefix didn't remove the matching keys")
+		}
+		if !cache.Contains("/users") || !cache.Contains("/group/1") || !cache.Contains(5) {
+			t.Error("RemovePrefix removed keys not matching the prefix")
+		}
+
+		// Keys removed by other means are removed from the index
+		cache.Remove("/users")
+		cache.RemoveOldest()
+		if n := cache.RemovePrefix("/"); n != 0 {
+			t.Error(fmt.Sprintf("RemovePrefix removed %v keys, expected 0", n))
+		}
+
+		cache.Set("/user/3", 3)
+		cache.Purge()
+		if n := cache.RemovePrefix("/"); n != 0 {
+			t.Error("Purge didn't clear the prefix index")
+		}
+		cache.Close()
+	}
+}
+
+func benchmarkRemovePrefix(b *testing.B, opts ...Option) {
+	cache := NewLRUCache(100000, 10, opts...)
+	for i := 0; i < 100000; i++ {
+		cache.Set(fmt.Sprintf("/tenant/%v/item/%v", i%10000, i), i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tenant := i % 10000
+		cache.RemovePrefix(fmt.Sprintf("/tenant/%v/", tenant))
+
+		// Restore the removed keys for the next iteration
+		b.StopTimer()
+		for j := tenant; j < 100000; j += 10000 {
+			cache.Set(fmt.Sprintf("/tenant/%v/item/%v", tenant, j), j)
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkRemovePrefixScan(b *testing.B) {
+	benchmarkRemovePrefix(b)
+}
+
+func BenchmarkRemovePrefixIndex(b *testing.B) {
+	benchmarkRemovePrefix(b, WithPrefixIndex())
+}
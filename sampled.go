@@ -0,0 +1,63 @@
+package simplelru
+
+import "time"
+
+// WithSampledEviction makes the cache approximate LRU like Redis does.
+// Instead of moving the entries to the newest end of the list on every Get,
+// each hit only records a logical access time, and eviction samples
+// sampleSize entries and evicts the least recently used among them. Larger
+// samples are closer to exact LRU but make evictions slower.
+//
+// The list order used by Oldest, Newest, Rank, RemoveOldest and the like
+// only reflects when the keys were Set, not the Get accesses. If all the
+// sampled entries are pinned or protected the oldest eligible entry in the
+// list is evicted.
+func WithSampledEviction(sampleSize int) Option {
+	return func(c *LRUCache) {
+		if sampleSize < 1 {
+			panic("WithSampledEviction: min sample size is 1")
+		}
+		c.sampleSize = sampleSize
+		c.accessed = make(map[interface{}]uint64, c.size)
+	}
+}
+
+// touch records an access to key
+func (c *LRUCache) touch(key interface{}) {
+	c.clock++
+	c.accessed[key] = c.clock
+}
+
+// popSampled removes the least recently accessed entry among a sample of the
+// unprotected entries. Map iteration order is random so ranging over the
+// access map gives a cheap sample.
+func (c *LRUCache) popSampled() (key interface{}, value interface{}, ok bool) {
+	var now time.Time
+	residency := c.minResidency > 0
+	if residency {
+		now = time.Now()
+	}
+
+	var victim interface{}
+	var oldest uint64
+	sampled := 0
+	for k, accessed := range c.accessed {
+		if c.protected(k, now, residency) {
+			continue
+		}
+		if sampled == 0 || accessed < oldest {
+			victim, oldest = k, accessed
+		}
+		if sampled++; sampled >= c.sampleSize {
+			break
+		}
+	}
+	if sampled == 0 {
+		return nil, nil, false
+	}
+
+	value, _ = c.cache.Get(victim)
+	c.cache.Delete(victim)
+	c.entryRemoved(victim, value)
+	return victim, value, true
+}
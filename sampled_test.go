@@ -0,0 +1,88 @@
+package simplelru
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSampledEviction(t *testing.T) {
+	// Sampling all the entries is exact LRU
+	cache := NewLRUCache(4, 1, WithSampledEviction(10))
+	for i := 0; i < 4; i++ {
+		cache.Set(i, i)
+	}
+	cache.Get(0)
+	cache.Get(1)
+
+	cache.Set(4, 4)
+	if cache.Contains(2) || !cache.Contains(0) {
+		t.Error("The least recently used key wasn't evicted")
+	}
+
+	// Hits don't move the keys in the list
+	if key, _, _ := cache.Oldest(); key != 0 {
+		t.Error("Get moved the key with sampled eviction")
+	}
+
+	// Pinned keys aren't evicted
+	cache.Pin(3)
+	cache.Set(5, 5)
+	if !cache.Contains(3) || cache.Contains(0) {
+		t.Error("Sampled eviction didn't skip the pinned key")
+	}
+
+	// Removed keys are forgotten
+	cache.Remove(1)
+	cache.Purge()
+	if len(cache.accessed) != 0 {
+		t.Error("Access times weren't removed with the entries")
+	}
+}
+
+func TestSampledEvictionApproximate(t *testing.T) {
+	// With small samples the hot keys should mostly survive
+	cache := NewLRUCache(1000, 1, WithSampledEviction(5))
+	for i := 0; i < 1000; i++ {
+		cache.Set(i, i)
+	}
+	for round := 0; round < 10; round++ {
+		for hot := 0; hot < 100; hot++ {
+			cache.Get(hot)
+		}
+		for i := 0; i < 100; i++ {
+			cache.Set(1000+round*100+i, i)
+		}
+	}
+
+	survivors := 0
+	for hot := 0; hot < 100; hot++ {
+		if cache.Contains(hot) {
+			survivors++
+		}
+	}
+	if survivors < 90 {
+		t.Errorf("Only %v hot keys survived", survivors)
+	}
+}
+
+func benchmarkHits(b *testing.B, cache *LRUCache, size int) {
+	for i := 0; i < size; i++ {
+		cache.Set(i, i)
+	}
+	keys := make([]int, 1024)
+	for i := range keys {
+		keys[i] = rand.Intn(size)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.Get(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkHitsExactLRU(b *testing.B) {
+	benchmarkHits(b, NewLRUCache(1<<20, 1), 1<<20)
+}
+
+func BenchmarkHitsSampledLRU(b *testing.B) {
+	benchmarkHits(b, NewLRUCache(1<<20, 1, WithSampledEviction(5)), 1<<20)
+}
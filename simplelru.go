@@ -1,31 +1,238 @@
 package simplelru
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/secnot/simplelru/orderedmap"
+	"math"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Buffer size of the channel returned by InvalidateChan
+const invalidateQueueSize = 128
+
+// Approximate memory overhead in bytes of each cache entry (list node and
+// map entry), used by MemoryUsage
+const entryOverhead = 96
+
+// Max number of keys listed by Dump
+const dumpMaxKeys = 100
+
+// Duration in seconds of the window used by EvictionRate
+const evictionWindow = 10
+
+// Last id assigned to a cache, updated atomically
+var lastCacheID uint64
+
+// WeighFunc returns the approximate size in bytes of a cached value
+type WeighFunc func(value interface{}) int64
+
 // FetchFunc is used to look up missing values when there is a cache miss.
+// A nil value returned with ok true is a valid value and is cached, only
+// ok false is a failed lookup.
 type FetchFunc func(key interface{}) (value interface{}, ok bool)
 
+// WriteFunc is used to store values in the backing store on Put calls.
+type WriteFunc func(key interface{}, value interface{}) error
+
+// FetchFuncCtx is a FetchFunc receiving a context, that is canceled when
+// the fetch timeout expires.
+type FetchFuncCtx func(ctx context.Context, key interface{}) (value interface{}, ok bool)
+
+// QueueFullPolicy selects what Get does when the fetch queue is full
+type QueueFullPolicy int
+
+const (
+	// QueueBlock waits until there is space in the queue (default)
+	QueueBlock QueueFullPolicy = iota
+
+	// QueueDrop returns a miss immediately without fetching the key
+	QueueDrop
+
+	// QueueTimeout waits for space in the queue up to a timeout, and then
+	// returns a miss
+	QueueTimeout
+)
+
 type fetchRequest struct {
-	value interface{}
-	ok    bool
-	ready chan struct{} //Close when request is ready
+	key    interface{}   // Key passed to the fetch function
+	keys   []interface{} // Keys the fetched value is cached as
+	value  interface{}
+	ok     bool
+	err    error
+	dups   int           // Number of callers that joined the request
+	filled bool          // The fetched value was cached as key
+	ready  chan struct{} //Close when request is ready
 }
 
-func newFetchRequest() *fetchRequest {
+func newFetchRequest(key interface{}) *fetchRequest {
 	return &fetchRequest{
+		key:   key,
+		keys:  []interface{}{key},
 		value: nil,
 		ok:    false,
 		ready: make(chan struct{}),
 	}
 }
 
+// FetchCompleteFunc is called with the result of a fetch
+type FetchCompleteFunc func(key interface{}, value interface{}, ok bool)
+
+// SlowFetchFunc is called with the key and duration of a slow fetch
+type SlowFetchFunc func(key interface{}, d time.Duration)
+
+// Option configures optional LRUCache features at construction time
+type Option func(*LRUCache)
+
+// WithPrefixIndex maintains an index of the string keys, so RemovePrefix
+// doesn't have to scan the whole cache. It adds some overhead to every
+// insertion and removal.
+func WithPrefixIndex() Option {
+	return func(c *LRUCache) {
+		c.prefixIndex = newPrefixIndex()
+	}
+}
+
+// Initial capacity of the caches created by NewByteCache
+const byteCacheInitialCap = 64
+
+// NewByteCache creates a LRUCache for []byte values limited by the total
+// length of the cached values instead of their number. The oldest entries
+// are evicted until the total is under maxBytes. A value longer than maxBytes
+// is ignored like the values above the max value size (see SetMaxValueSize),
+// without evicting any entry. Values that aren't []byte weigh 0 bytes.
+func NewByteCache(maxBytes int64) *LRUCache {
+	if maxBytes < 1 {
+		panic("NewByteCache: min cache size is 1 byte")
+	}
+
+	weigher := func(value interface{}) int64 {
+		if b, ok := value.([]byte); ok {
+			return int64(len(b))
+		}
+		return 0
+	}
+
+	c := NewLRUCache(byteCacheInitialCap, 1, WithWeigher(weigher))
+	c.size = math.MaxInt32 // Only limited by maxWeight
+	c.maxWeight = maxBytes
+	return c
+}
+
+// WithRecentHitRatio enables tracking the hits and misses over the last
+// window (rounded up to whole seconds) for RecentHitRatio.
+func WithRecentHitRatio(window time.Duration) Option {
+	return func(c *LRUCache) {
+		seconds := int((window + time.Second - 1) / time.Second)
+		if seconds < 1 {
+			panic("WithRecentHitRatio: min window is 1 second")
+		}
+		c.recentHits = newSlidingWindow(seconds)
+		c.recentMisses = newSlidingWindow(seconds)
+	}
+}
+
+// WithMRUEviction makes the cache evict the most recently used entries
+// instead of the least recently used ones. It suits workloads where the
+// newest entries are the least likely to be used again, like repeated
+// sequential scans of a dataset larger than the cache, where LRU evicts
+// every entry just before it is needed again. Explicit RemoveOldest and
+// PopOldest calls are not affected.
+func WithMRUEviction() Option {
+	return func(c *LRUCache) {
+		c.evictNewest = true
+	}
+}
+
+// WithFIFOEviction turns the cache into a fixed size FIFO queue: accessing
+// or updating an entry doesn't make it more recent, so entries are evicted
+// strictly in insertion order, and a value replaced by Set keeps its place.
+// Combined with WithMRUEviction the newest entry is evicted first (LIFO).
+func WithFIFOEviction() Option {
+	return func(c *LRUCache) {
+		c.fifo = true
+	}
+}
+
+// WithName names the cache, to tell apart the caches of a process in the
+// String output and Metrics.
+func WithName(name string) Option {
+	return func(c *LRUCache) {
+		c.name = name
+	}
+}
+
+// WithWeigher sets the function used to weigh the cached values, the total
+// weight is included in the MemoryUsage estimate.
+func WithWeigher(weigher WeighFunc) Option {
+	return func(c *LRUCache) {
+		c.weigher = weigher
+	}
+}
+
+// WithWriter sets the function used by Put to write values to the backing
+// store, making the cache write-through. If it is called concurrently it
+// must be concurrency-safe.
+func WithWriter(writer WriteFunc) Option {
+	return func(c *LRUCache) {
+		c.writer = writer
+	}
+}
+
+// WithAgeTracking records the time each key was inserted, required by
+// AgeHistogram. SetMinResidency enables it too.
+func WithAgeTracking() Option {
+	return func(c *LRUCache) {
+		c.inserted = make(map[interface{}]time.Time)
+	}
+}
+
+// WithAccessTracking records the last time each key was set or read with
+// Get and its variants, required by LastAccess. Peek and GetNoPromote aren't
+// accesses.
+func WithAccessTracking() Option {
+	return func(c *LRUCache) {
+		c.lastAccess = make(map[interface{}]time.Time)
+	}
+}
+
+// WithFetchMapHint preallocates space for n concurrent fetches, to avoid
+// growing the map of pending fetches during bursts of misses.
+func WithFetchMapHint(n int) Option {
+	return func(c *LRUCache) {
+		c.fetchM = make(map[interface{}]*fetchRequest, n)
+	}
+}
+
+// WithCoalesceKey sets a function that normalizes the keys when grouping
+// concurrent fetches, so Get calls for different keys with the same
+// normalized key share a single fetch. The fetch function receives the key
+// of the Get call that started the fetch, and the fetched value is cached
+// under every key requested while it was in progress, so the same value may
+// end up cached several times under different keys. A Set call for any of
+// those keys hands its value to all the goroutines waiting for the fetch.
+func WithCoalesceKey(coalesce func(key interface{}) interface{}) Option {
+	return func(c *LRUCache) {
+		c.coalesce = coalesce
+	}
+}
+
 // LRUCache is a standard implementation of a LRU cache with an optional
 // worker pool for fetching missing values.
 type LRUCache struct {
+	// Fetch latency stats, updated atomically (first for 64-bit alignment)
+	fetchCount uint64
+	fetchNanos int64
+
+	// Fetch queue stats, updated atomically
+	enqueuedCount uint64
+	droppedCount  uint64
+
 	// Wait for lookup task exits
 	wg sync.WaitGroup
 
@@ -41,16 +248,158 @@ type LRUCache struct {
 	// Elements pruned everytime the cache if full
 	pruneSize int
 
+	// Fraction of the cache pruned when full, overrides pruneSize if not 0
+	pruneFraction float64
+
 	// Hit miss stats
 	hitCount  uint64
 	missCount uint64
 
+	// Purge stats, see Metrics
+	purgeCount  uint64
+	purgedCount uint64
+
 	// Lookup function for missing keys
-	fetcher FetchFunc
+	fetcher      FetchFuncCtx
+	fetchTimeout time.Duration
+
+	// Write function for Put
+	writer WriteFunc
+
+	// Write-behind queue and flush settings
+	writeBehind    bool
+	pendingW       map[interface{}]interface{}
+	writeInterval  time.Duration
+	writeBatchSize int
+	flushSignal    chan struct{}
+	flushLock      sync.Mutex
 
 	// Map and queue of keys waiting to be fetched
 	fetchM map[interface{}]*fetchRequest
 	fetchQ chan interface{} // lookup request key queue
+
+	// Key normalization for fetchM (optional)
+	coalesce func(key interface{}) interface{}
+
+	// What to do when fetchQ is full
+	queuePolicy  QueueFullPolicy
+	queueTimeout time.Duration
+	maxWaiters   int         // Max callers waiting for a fetch, 0 for no limit
+	prioQ        *fetchQueue // Fetch queue priority order (optional)
+	batchFetcher BatchFetchFunc
+	missHandler  FetchFunc // Inline lookup without fetcher, see SetMissHandler
+
+	// Index of string keys (optional)
+	prefixIndex *prefixIndex
+
+	// Index of entry tags, created by the first SetWithTags
+	tags *tagIndex
+
+	// Eviction counts per key (optional), see WithEvictionTracking
+	evictedKeys *spaceSaving
+
+	// Copies the values returned to the callers (optional)
+	clone CloneFunc
+
+	// Name set by WithName (optional)
+	name string
+
+	// Unique cache id, orders the locks of operations on two caches
+	id uint64
+
+	// Semaphore limiting the concurrent gets (chan struct{}, nil for no
+	// limit), see SetMaxConcurrentGets
+	getSem atomic.Value
+
+	// Access frequencies for the admission policy (optional)
+	sketch *frequencySketch
+
+	// Distinct cached values shared between keys (optional)
+	interned *internTable
+
+	// Value weigh function (optional) and total weight of cached values
+	weigher   WeighFunc
+	weight    int64
+	maxWeight int64 // Max total weight, 0 for no limit
+
+	maxValueSize int64 // Max weight of a single value, 0 for no limit
+
+	// Operations timing (optional)
+	tracer Tracer
+
+	// Approximate LRU access clock per key, see WithSampledEviction
+	accessed   map[interface{}]uint64
+	clock      uint64
+	sampleSize int
+
+	// Entries younger than this aren't evicted, see SetMinResidency
+	minResidency time.Duration
+
+	// Evict the most recently used entries, see WithMRUEviction
+	evictNewest bool
+
+	// Don't promote accessed or updated entries, see WithFIFOEviction
+	fifo bool
+
+	// Recent hits and misses, see WithRecentHitRatio
+	recentHits   *slidingWindow
+	recentMisses *slidingWindow
+
+	// Recent evictions, for EvictionRate
+	evictions *slidingWindow
+
+	// Called when the cache becomes full, see SetOnFull
+	onFull    func()
+	saturated bool
+
+	// Called after each fetch, see SetOnFetchComplete
+	onFetchComplete FetchCompleteFunc
+
+	// Called after fetches slower than the threshold, see SetOnSlowFetch
+	onSlowFetch   SlowFetchFunc
+	slowThreshold time.Duration
+
+	// Eviction callback and values auto-close, see evict.go
+	onEvict    EvictFunc
+	autoClose  bool
+	onCloseErr func(key interface{}, err error)
+
+	// Key insertion times (optional)
+	inserted map[interface{}]time.Time
+
+	// Key last access times (optional)
+	lastAccess map[interface{}]time.Time
+
+	// Keys exempt from pruning
+	pinned map[interface{}]struct{}
+
+	// Read-only mode, see Freeze
+	frozen bool
+
+	// Keys queued for removal, see InvalidateChan
+	invalidateQ chan interface{}
+
+	// Calls in progress started by Do
+	callM map[interface{}]*fetchRequest
+
+	// Test seams, see workerHooks
+	hooks workerHooks
+
+	// Closed to signal background goroutines to exit
+	done   chan struct{}
+	closed bool
+
+	// Closed when fetchM becomes empty, see Shutdown and WaitIdle
+	drained chan struct{}
+}
+
+// workerHooks are called by the fetch workers at points where tests need to
+// interleave other operations deterministically. They are only set by tests,
+// before the workers start.
+type workerHooks struct {
+	beforeFetch   func(key interface{}) // After taking a request, before fetching
+	afterFetch    func(key interface{}) // After fetching, before locking the cache
+	afterComplete func(key interface{}) // After the fetch result was processed
 }
 
 // goFetchWorkerFucn is the value fetching worker goroutine
@@ -59,51 +408,121 @@ func (c *LRUCache) goFetchWorkerFunc() {
 	defer c.wg.Done()
 	for {
 		// Next key for lookup
-		key, ok := <-c.fetchQ
-		if !ok {
-			return // Received exit signal
+		var ckey interface{}
+		if c.prioQ == nil {
+			select {
+			case ckey = <-c.fetchQ:
+			case <-c.done:
+				return // Received exit signal
+			}
+		} else {
+			select {
+			case <-c.prioQ.ready:
+			case <-c.done:
+				return // Received exit signal
+			}
+			ckey = c.prioQ.Pop()
+			<-c.fetchQ // Release the queue slot
 		}
 
 		// Check the request for the keys is still waiting and hasn't been
 		// removed by a Set call
 		c.Lock()
-		if _, ok := c.fetchM[key]; !ok {
+		request, ok := c.fetchM[ckey]
+		if !ok {
 			c.Unlock()
 			continue
 		}
+		key := request.key
+		onSlow, threshold := c.onSlowFetch, c.slowThreshold
 		c.Unlock()
 
+		if c.hooks.beforeFetch != nil {
+			c.hooks.beforeFetch(key)
+		}
+
 		// Use fetch function
-		value, fetchOk := c.fetcher(key)
+		start := time.Now()
+		value, fetchOk := c.fetch(key)
+		elapsed := time.Since(start)
+		atomic.AddInt64(&c.fetchNanos, int64(elapsed))
+		atomic.AddUint64(&c.fetchCount, 1)
+
+		if c.hooks.afterFetch != nil {
+			c.hooks.afterFetch(key)
+		}
 		if !fetchOk {
-			// If the lookup failed discard the value as a precaution
+			// If the lookup failed discard the value as a precaution,
+			// ok (not the value) tells failed lookups from nil values
 			value = nil
 		}
 
-		// Check once more if the request was removed from fetchM,
-		// if not, set the value and signal waiting goroutines
+		// Check once more if the request was removed from fetchM (by
+		// Set or PurgeAll), if not, set the value and signal waiting
+		// goroutines. The request itself is compared, not only the key,
+		// a newer request for the same key started after a Set must not
+		// receive this older value.
 		c.Lock()
-		if request, stillWaiting := c.fetchM[key]; stillWaiting {
-			request.value = value
-			request.ok = fetchOk
+		var onComplete FetchCompleteFunc
+		if c.fetchM[ckey] == request {
+			onComplete = c.onFetchComplete
+			c.completeRequest(ckey, request, value, fetchOk)
+		}
+		c.Unlock()
 
-			// All blocked Get methods keep a reference, so it can
-			// be deleted safely
-			delete(c.fetchM, key)
+		if onSlow != nil && threshold > 0 && elapsed > threshold {
+			onSlow(key, elapsed)
+		}
+		if onComplete != nil {
+			onComplete(key, value, fetchOk)
+		}
+		if c.hooks.afterComplete != nil {
+			c.hooks.afterComplete(key)
+		}
+	}
+}
 
-			// Clossing the channel marks the request finished
-			close(request.ready)
+// completeRequest finishes a fetch request with its result, and caches the
+// value if the fetch was successful. Must be called with the lock held.
+func (c *LRUCache) completeRequest(ckey interface{}, request *fetchRequest,
+	value interface{}, ok bool) {
+	request.value = value
+	request.ok = ok
 
-			// Only update the cache if fetching was successful
-			if fetchOk {
-				if c.cache.Len() >= c.size {
-					c.prune(c.pruneSize)
+	// Only update the cache if fetching was successful. Keys cached
+	// after the fetch started (by SwapContents) are newer than
+	// the fetched value, Set has priority over fetched values.
+	if ok && !c.frozen && !c.oversized(value) {
+		for _, key := range request.keys {
+			if _, cached := c.cache.Get(key); !cached {
+				if _, added := c.addEntry(key, value); added {
+					request.filled = request.filled || key == request.key
 				}
-				c.cache.Set(key, value)
 			}
 		}
-		c.Unlock()
 	}
+
+	// All blocked Get methods keep a reference, so it can be deleted safely
+	c.finishRequest(ckey, request)
+}
+
+// fetch calls the fetch function with a context expiring after the fetch
+// timeout. Values returned after the deadline are discarded.
+func (c *LRUCache) fetch(key interface{}) (value interface{}, ok bool) {
+	c.Lock()
+	timeout := c.fetchTimeout
+	c.Unlock()
+
+	if timeout <= 0 {
+		return c.fetcher(context.Background(), key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if value, ok = c.fetcher(ctx, key); ctx.Err() != nil {
+		return nil, false
+	}
+	return value, ok
 }
 
 // NewFetchingLRUCache creates a LRUCache with fetch function to retrieve keys on
@@ -117,21 +536,31 @@ func (c *LRUCache) goFetchWorkerFunc() {
 func NewFetchingLRUCache(size int, pruneSize int,
 	fetcher FetchFunc,
 	fetchWorkers uint32,
-	fetchQueueSize uint32) *LRUCache {
-	if size < 1 {
-		panic("NewFetchingLRUCache: min cache size is 1")
-	}
-	if pruneSize < 1 {
-		panic("NewFetchingLRUCache: min prune size is 1")
-	}
-	if fetcher != nil && fetchWorkers < 1 {
-		panic("NewFetchingLRUCache: The min worker pool size is 1")
+	fetchQueueSize uint32,
+	opts ...Option) *LRUCache {
+	var fetcherCtx FetchFuncCtx
+	if fetcher != nil {
+		fetcherCtx = func(_ context.Context, key interface{}) (interface{}, bool) {
+			return fetcher(key)
+		}
 	}
-	if fetcher != nil && fetchQueueSize < 1 {
-		panic("NewFetchingLRUCache: The min fetch job queue size is 1")
+	return NewContextFetchingLRUCache(size, pruneSize, fetcherCtx,
+		fetchWorkers, fetchQueueSize, opts...)
+}
+
+// NewContextFetchingLRUCache creates a LRUCache with a context aware fetch
+// function, see NewFetchingLRUCache and SetFetchTimeout.
+func NewContextFetchingLRUCache(size int, pruneSize int,
+	fetcher FetchFuncCtx,
+	fetchWorkers uint32,
+	fetchQueueSize uint32,
+	opts ...Option) *LRUCache {
+	if err := checkArgs(size, pruneSize, fetcher != nil, fetchWorkers, fetchQueueSize); err != nil {
+		panic(err.Error())
 	}
 
 	cache := &LRUCache{
+		id:        atomic.AddUint64(&lastCacheID, 1),
 		cache:     orderedmap.NewOrderedMap(size + 1),
 		size:      size,
 		pruneSize: pruneSize,
@@ -140,6 +569,22 @@ func NewFetchingLRUCache(size int, pruneSize int,
 		fetcher:   fetcher,
 		fetchM:    make(map[interface{}]*fetchRequest),
 		fetchQ:    make(chan interface{}, fetchQueueSize),
+		callM:     make(map[interface{}]*fetchRequest),
+		pinned:    make(map[interface{}]struct{}),
+		evictions: newSlidingWindow(evictionWindow),
+		done:      make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(cache)
+	}
+
+	if cache.writeBehind {
+		if cache.writer == nil {
+			panic("NewFetchingLRUCache: write-behind requires a writer")
+		}
+		cache.wg.Add(1)
+		go cache.goFlushFunc()
 	}
 
 	if fetcher != nil {
@@ -154,32 +599,203 @@ func NewFetchingLRUCache(size int, pruneSize int,
 }
 
 // NewLRUCache allocate LRUCache without lookup function
-func NewLRUCache(size int, pruneSize int) *LRUCache {
-	return NewFetchingLRUCache(size, pruneSize, nil, 0, 0)
+func NewLRUCache(size int, pruneSize int, opts ...Option) *LRUCache {
+	return NewFetchingLRUCache(size, pruneSize, nil, 0, 0, opts...)
 }
 
-func (c *LRUCache) growCache(size int) {
+// checkArgs validates the cache constructor arguments
+func checkArgs(size int, pruneSize int, fetching bool,
+	fetchWorkers uint32, fetchQueueSize uint32) error {
+	switch {
+	case size < 1:
+		return errors.New("NewFetchingLRUCache: min cache size is 1")
+	case pruneSize < 1:
+		return errors.New("NewFetchingLRUCache: min prune size is 1")
+	case fetching && fetchWorkers < 1:
+		return errors.New("NewFetchingLRUCache: The min worker pool size is 1")
+	case fetching && fetchQueueSize < 1:
+		return errors.New("NewFetchingLRUCache: The min fetch job queue size is 1")
+	}
+	return nil
+}
 
-	newCache := orderedmap.NewOrderedMap(size)
-	for {
-		key, value, ok := c.cache.PopFirst()
-		if !ok {
+// NewLRUCacheE is NewLRUCache returning an error instead of panicking when
+// the arguments are invalid. Invalid options still panic.
+func NewLRUCacheE(size int, pruneSize int, opts ...Option) (*LRUCache, error) {
+	return NewFetchingLRUCacheE(size, pruneSize, nil, 0, 0, opts...)
+}
+
+// NewFetchingLRUCacheE is NewFetchingLRUCache returning an error instead of
+// panicking when the arguments are invalid. Invalid options still panic.
+func NewFetchingLRUCacheE(size int, pruneSize int,
+	fetcher FetchFunc,
+	fetchWorkers uint32,
+	fetchQueueSize uint32,
+	opts ...Option) (*LRUCache, error) {
+	if err := checkArgs(size, pruneSize, fetcher != nil, fetchWorkers, fetchQueueSize); err != nil {
+		return nil, err
+	}
+	return NewFetchingLRUCache(size, pruneSize, fetcher, fetchWorkers, fetchQueueSize, opts...), nil
+}
+
+// setEntry adds or updates a cache entry
+func (c *LRUCache) setEntry(key interface{}, value interface{}) {
+	value = c.intern(value)
+	if old, ok := c.cache.Get(key); ok {
+		if c.interned != nil {
+			c.interned.Release(old)
+		}
+		if c.weigher != nil {
+			c.weight -= c.weigher(old)
+		}
+		if c.autoClose && !sameValue(old, value) {
+			c.discard(key, old)
+		}
+	}
+	if c.weigher != nil {
+		c.weight += c.weigher(value)
+	}
+	if c.maxWeight > 0 && c.cache.Len() >= c.cache.Cap() {
+		// Caches bounded by weight grow on demand
+		if _, exists := c.cache.Get(key); !exists {
+			c.cache.Reserve(2 * c.cache.Cap())
+		}
+	}
+	c.cache.Set(key, value)
+	if c.accessed != nil {
+		c.touch(key)
+	}
+	if c.inserted != nil {
+		if _, exists := c.inserted[key]; !exists {
+			c.inserted[key] = time.Now()
+		}
+	}
+	if c.lastAccess != nil {
+		c.lastAccess[key] = time.Now()
+	}
+	if c.prefixIndex != nil {
+		if s, isString := key.(string); isString {
+			c.prefixIndex.Add(s)
+		}
+	}
+	c.trimWeight()
+}
+
+// trimWeight evicts the oldest entries until the total weight is under the
+// limit.
+func (c *LRUCache) trimWeight() {
+	for c.maxWeight > 0 && c.weight > c.maxWeight {
+		if !c.evict() {
 			break
 		}
+		c.evictions.Add(time.Now(), 1)
+	}
+}
+
+// entryRemoved updates the cache bookkeeping after an entry is removed
+func (c *LRUCache) entryRemoved(key interface{}, value interface{}) {
+	c.saturated = false
+	delete(c.pinned, key)
+	delete(c.inserted, key)
+	delete(c.lastAccess, key)
+	if c.accessed != nil {
+		delete(c.accessed, key)
+	}
+	if c.weigher != nil {
+		c.weight -= c.weigher(value)
+	}
+	if c.prefixIndex != nil {
+		if s, isString := key.(string); isString {
+			c.prefixIndex.Remove(s)
+		}
+	}
+	if c.tags != nil {
+		c.tags.Remove(key)
+	}
+	if c.interned != nil {
+		c.interned.Release(value)
+	}
+}
+
+// addEntry inserts a new key, pruning the cache first if it is full. Returns
+// false if the key couldn't be inserted because only pinned entries were left,
+// or the admission filter rejected it.
+func (c *LRUCache) addEntry(key interface{}, value interface{}) (pruned bool, added bool) {
+	if c.cache.Len() >= c.size {
+		if !c.admit(key) {
+			return false, false
+		}
+		saturated := c.saturated
+		c.prune(c.pruneCount())
+		pruned = true
+
+		c.saturated = true
+		if !saturated && c.onFull != nil {
+			c.onFull()
+		}
+
+		if c.cache.Len() >= c.size {
+			return pruned, false
+		}
+	}
+
+	// The new value is set after the purge to assure it is not deleted
+	// when the cache size is one, or the prune size is greater than cache size
+	c.setEntry(key, value)
+	return pruned, true
+}
+
+// deleteEntry removes a key from cache
+func (c *LRUCache) deleteEntry(key interface{}) (value interface{}, ok bool) {
+	if value, ok = c.cache.Get(key); ok {
+		c.cache.Delete(key)
+		c.entryRemoved(key, value)
+		c.discard(key, value)
+	}
+	return
+}
 
-		// Add records to new cache
-		err := newCache.Set(key, value)
-		if err == orderedmap.ErrFull {
-			newCache.PopFirst()
+// deleteEntries removes a batch of keys from cache
+func (c *LRUCache) deleteEntries(keys []interface{}) int {
+	for _, key := range keys {
+		if value, ok := c.cache.Get(key); ok {
+			c.entryRemoved(key, value)
+			c.discard(key, value)
 		}
-		newCache.Set(key, value)
 	}
-	c.cache = newCache
+	return c.cache.DeleteMulti(keys)
+}
+
+// popEntry removes the newest or oldest cache entry
+func (c *LRUCache) popEntry(last bool) (key interface{}, value interface{}, ok bool) {
+	if key, value, ok = c.cache.Pop(last); ok {
+		c.entryRemoved(key, value)
+	}
+	return
+}
+
+// TrimToSize evicts the least recently used entries until there are at most
+// target entries, without changing the cache size, and returns the number of
+// entries evicted. Evicted entries are reported to the eviction callback (see
+// SetOnEvict). Pinned and protected entries (see SetMinResidency) aren't
+// evicted, so fewer entries may be evicted. It can be used to release memory
+// under pressure without limiting the cache afterwards.
+func (c *LRUCache) TrimToSize(target int) int {
+	c.Lock()
+	defer c.Unlock()
+	if c.frozen || c.cache.Len() <= target {
+		return 0
+	}
+	before := c.cache.Len()
+	c.prune(before - target)
+	return before - c.cache.Len()
 }
 
 // Resize sets new max cache size, if its smaller than the current size
 // it will be pruned to size. (ignores pruneSize)
-// WARNING: Resizing the cache is an expensive operation.
+// Growing the cache only allocates the missing capacity, the cached entries
+// are left in place, so concurrent Gets are blocked for the allocation but
+// not for a rebuild of the cache.
 func (c *LRUCache) Resize(size int, pruneSize int) {
 	if size < 1 {
 		panic("LRUCache: min cache size is 1")
@@ -189,139 +805,1404 @@ func (c *LRUCache) Resize(size int, pruneSize int) {
 	}
 
 	c.Lock()
+	if c.frozen {
+		c.Unlock()
+		return
+	}
 
 	if c.cache.Cap() < size {
 		// New size is bigger than current
-		c.growCache(size)
+		c.cache.Reserve(size)
 	} else if size < c.cache.Len() {
 		// New size is smaller than current prune oldest
 		c.prune(c.cache.Len() - size)
 	}
 
+	if size > c.size {
+		c.saturated = false
+	}
 	c.size = size
 	c.pruneSize = pruneSize
 
 	c.Unlock()
 }
 
-// prune Remove pruneSize elements from cache
-func (c *LRUCache) prune(size int) {
-	for x := size; x > 0; x-- {
-		if _, _, ok := c.cache.PopFirst(); !ok {
-			break // Cache is already empty
-		}
+// pruneCount returns the number of entries to prune when the cache is full
+func (c *LRUCache) pruneCount() int {
+	if c.pruneFraction <= 0 {
+		return c.pruneSize
+	}
+	if count := int(c.pruneFraction * float64(c.cache.Len())); count > 1 {
+		return count
 	}
+	return 1
 }
 
-// Len returns the number of cached items
-func (c *LRUCache) Len() (size int) {
+// SetPruneFraction sets the fraction of the cached entries pruned when the
+// cache is full instead of a fixed pruneSize, so 0.1 prunes 10% of the
+// entries (at least one). Values above 1 prune the whole cache, zero
+// restores the pruneSize.
+func (c *LRUCache) SetPruneFraction(f float64) {
 	c.Lock()
-	size = c.cache.Len()
+	c.pruneFraction = math.Min(math.Max(f, 0), 1)
 	c.Unlock()
-	return
 }
 
-// Get a key value, if not cached use the fetch function if available.
-func (c *LRUCache) Get(key interface{}) (value interface{}, ok bool) {
-	c.Lock()
-
-	if value, ok = c.cache.Get(key); ok {
-		c.hitCount++
-		c.cache.MoveLast(key)
-		c.Unlock()
-	} else if c.fetcher != nil {
-		c.missCount++
-		request, exists := c.fetchM[key]
-		if !exists { // Start new request
-			request = newFetchRequest()
-			c.fetchM[key] = request
-			c.Unlock()
-			c.fetchQ <- key // Queue key for fetch
-		} else {
-			c.Unlock()
+// prune Remove pruneSize elements from cache
+func (c *LRUCache) prune(size int) {
+	evicted := 0
+	for ; evicted < size; evicted++ {
+		if !c.evict() {
+			break // Cache is already empty
 		}
-
-		// Wait until the lookup has finished
-		<-request.ready // Wait until lookup is done
-		value, ok = request.value, request.ok
-	} else {
-		c.missCount++
-		c.Unlock()
 	}
-	return
+	if evicted > 0 {
+		c.evictions.Add(time.Now(), uint64(evicted))
+	}
 }
 
-// Set or update key value, returns true if the cache was pruned to make space
-// for a new key. Set has priority over fetched values, so if the key is
-// being fetched, all goroutines waiting will wakeup and receive the 'setted' value
-// while the fetch results are discarded.
-func (c *LRUCache) Set(key interface{}, value interface{}) (pruned bool) {
-	c.Lock()
+// evict evicts the oldest entry that isn't pinned, or the newest one with
+// WithMRUEviction.
+func (c *LRUCache) evict() bool {
+	var key, value interface{}
+	var ok bool
+	if c.accessed != nil {
+		key, value, ok = c.popSampled()
+	}
+	if !ok {
+		key, value, ok = c.popUnpinned(c.evictNewest, true)
+	}
+	if ok {
+		if c.evictedKeys != nil {
+			c.evictedKeys.Add(key)
+		}
+		if c.onEvict != nil {
+			c.onEvict(key, value)
+		}
+		c.discard(key, value)
+	}
+	return ok
+}
 
-	inCache := false
+// protected returns true if key is pinned, or when residency is true if it
+// was inserted less than the min residency before now.
+func (c *LRUCache) protected(key interface{}, now time.Time, residency bool) bool {
+	if _, pinned := c.pinned[key]; pinned {
+		return true
+	}
+	if residency {
+		inserted, tracked := c.inserted[key]
+		return tracked && now.Sub(inserted) < c.minResidency
+	}
+	return false
+}
 
-	if _, inCache = c.cache.Get(key); inCache {
-		// Already in cache, just update
-		c.cache.MoveLast(key)
-	} else if request, fetching := c.fetchM[key]; fetching {
-		// In lookup queue (but not in cache)
-		request.value = value
-		request.ok = true
+// popOldest removes the oldest entry that isn't pinned, the pinned entries
+// found on the way are moved to the newest end.
+func (c *LRUCache) popOldest() (key interface{}, value interface{}, ok bool) {
+	return c.popUnpinned(false, false)
+}
 
-		// All blocked Get methods keep a reference so it can be deleted safely
-		delete(c.fetchM, key)
+// popUnpinned removes the oldest, or newest if last is true, entry that isn't
+// pinned, or when evicting younger than the min residency. The skipped
+// entries found on the way are moved to the other end.
+func (c *LRUCache) popUnpinned(last bool, evicting bool) (key interface{}, value interface{}, ok bool) {
+	if c.cache.Len() <= len(c.pinned) {
+		return nil, nil, false
+	}
 
-		// Clossing the channel marks request finished
-		close(request.ready)
+	var now time.Time
+	residency := evicting && c.minResidency > 0
+	if residency {
+		now = time.Now()
 	}
 
-	if !inCache && c.cache.Len() >= c.size {
-		c.prune(c.pruneSize)
-		pruned = true
+	for i := c.cache.Len(); i > 0; i-- {
+		if last {
+			key, _, _ = c.cache.GetLast()
+		} else {
+			key, _, _ = c.cache.GetFirst()
+		}
+		if !c.protected(key, now, residency) {
+			return c.popEntry(last)
+		}
+		c.cache.Move(key, !last)
+	}
+	return nil, nil, false
+}
+
+// EvictionRate returns the number of entries evicted per second to make room
+// for new ones, averaged over the last 10 seconds. Explicit removals and
+// Purge are not evictions. It can be used to drive Resize, a high rate
+// means the cache is too small for the working set.
+func (c *LRUCache) EvictionRate() float64 {
+	c.Lock()
+	defer c.Unlock()
+	return float64(c.evictions.Sum(time.Now())) / evictionWindow
+}
+
+// Bytes returns the total weight of the cached values, for caches created
+// with NewByteCache the sum of the values length.
+func (c *LRUCache) Bytes() int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.weight
+}
+
+// MemoryUsage returns an estimate in bytes of the memory used by the cache
+// entries, the weight of all the values plus a fixed overhead per entry.
+// Without a weigher it only includes the entries overhead.
+func (c *LRUCache) MemoryUsage() int64 {
+	c.Lock()
+	defer c.Unlock()
+	return int64(c.cache.Len())*entryOverhead + c.weight
+}
+
+// AgeHistogram returns the number of cached keys by time since insertion,
+// the count at index i is the number of keys with age in the range
+// [buckets[i-1], buckets[i]), and the last one the keys older than the last
+// bucket. The buckets must be sorted. Returns nil unless insertion times are
+// tracked, enabled by WithAgeTracking or SetMinResidency (which doesn't
+// count the keys cached before it was called).
+func (c *LRUCache) AgeHistogram(buckets []time.Duration) []int {
+	c.Lock()
+	defer c.Unlock()
+	if c.inserted == nil {
+		return nil
+	}
+
+	now := time.Now()
+	histogram := make([]int, len(buckets)+1)
+	for _, inserted := range c.inserted {
+		age := now.Sub(inserted)
+		i := 0
+		for i < len(buckets) && age >= buckets[i] {
+			i++
+		}
+		histogram[i]++
+	}
+	return histogram
+}
+
+// LastAccess returns the last time the key was set or read with Get, false
+// if it isn't cached or there is no WithAccessTracking.
+func (c *LRUCache) LastAccess(key interface{}) (time.Time, bool) {
+	c.Lock()
+	defer c.Unlock()
+	accessed, ok := c.lastAccess[key]
+	return accessed, ok
+}
+
+// Len returns the number of cached items
+func (c *LRUCache) Len() (size int) {
+	c.Lock()
+	size = c.cache.Len()
+	c.Unlock()
+	return
+}
+
+// Result is the value of a key returned by batch operations
+type Result struct {
+	Value interface{}
+	OK    bool
+}
+
+// getLocked returns the cached value for key, or the fetch request to wait
+// for if the key is being fetched. When isNew is true the request was just
+// created and the caller must queue it once the lock is released. If promote
+// is true cache hits are moved to the newest position. Must be called with
+// the lock held.
+func (c *LRUCache) getLocked(key interface{}, promote bool) (value interface{}, ok bool,
+	request *fetchRequest, isNew bool) {
+
+	if value, ok = c.lookup(key, promote); ok || c.fetcher == nil {
+		return
+	}
+	request, isNew = c.joinFetch(key)
+	return nil, false, request, isNew
+}
+
+// lookup returns the cached value for key updating the stats, if promote is
+// true cache hits are moved to the newest position. Must be called with the
+// lock held.
+func (c *LRUCache) lookup(key interface{}, promote bool) (value interface{}, ok bool) {
+	if c.sketch != nil {
+		c.sketch.Increment(key)
+	}
+	if value, ok = c.cache.Get(key); ok {
+		c.hitCount++
+		if c.recentHits != nil {
+			c.recentHits.Add(time.Now(), 1)
+		}
+		if promote && c.lastAccess != nil {
+			c.lastAccess[key] = time.Now()
+		}
+		if promote && !c.frozen && !c.fifo {
+			if c.accessed != nil {
+				c.touch(key)
+			} else {
+				c.cache.MoveLast(key)
+			}
+		}
+		return c.cloneValue(value, ok)
+	}
+
+	c.missCount++
+	if c.recentMisses != nil {
+		c.recentMisses.Add(time.Now(), 1)
+	}
+	return
+}
+
+// joinFetch returns the fetch request to wait for a missing key. When isNew
+// is true the request was just created and the caller must start the fetch.
+// Returns a nil request if the key can't be fetched. Must be called with the
+// lock held.
+func (c *LRUCache) joinFetch(key interface{}) (request *fetchRequest, isNew bool) {
+	if c.frozen || c.closed {
+		return nil, false
+	}
+
+	ckey := c.coalesceKey(key)
+	request, exists := c.fetchM[ckey]
+	if !exists { // Start new request
+		request = newFetchRequest(key)
+		c.fetchM[ckey] = request
+		return request, true
+	}
+
+	if c.maxWaiters > 0 && request.dups+1 >= c.maxWaiters {
+		// Too many callers waiting already, fail fast
+		return nil, false
+	}
+	request.dups++
+	if c.coalesce != nil {
+		request.addKey(key)
+	}
+	return request, false
+}
+
+// coalesceKey returns the key used to group fetch requests in fetchM
+func (c *LRUCache) coalesceKey(key interface{}) interface{} {
+	if c.coalesce == nil {
+		return key
+	}
+	return c.coalesce(key)
+}
+
+// addKey adds a key to the list of keys the fetched value is cached as
+func (r *fetchRequest) addKey(key interface{}) {
+	for _, k := range r.keys {
+		if k == key {
+			return
+		}
+	}
+	r.keys = append(r.keys, key)
+}
+
+// Get a key value, if not cached use the fetch function if available.
+func (c *LRUCache) Get(key interface{}) (value interface{}, ok bool) {
+	value, ok, _ = c.get(key, true)
+	return
+}
+
+// GetNoPromote is the same as Get but without refreshing the key, so
+// scanning the cache doesn't change the eviction order.
+func (c *LRUCache) GetNoPromote(key interface{}) (value interface{}, ok bool) {
+	value, ok, _ = c.get(key, false)
+	return
+}
+
+// get is Get and GetNoPromote, busy is true if it failed because of the max
+// concurrent gets.
+func (c *LRUCache) get(key interface{}, promote bool) (value interface{}, ok bool, busy bool) {
+	sem, acquired := c.acquireGet()
+	if !acquired {
+		return nil, false, true
+	}
+	defer releaseGet(sem)
+
+	lt := c.lockTraced()
+	value, ok, request, isNew := c.getLocked(key, promote)
+	policy, timeout := c.queuePolicy, c.queueTimeout
+	missHandler := c.missHandler
+	if promote {
+		c.unlockTraced("Get", lt)
+	} else {
+		c.unlockTraced("GetNoPromote", lt)
+	}
+
+	if request == nil {
+		if !ok && missHandler != nil && c.fetcher == nil {
+			value, ok, _ = c.handleMiss(key, missHandler)
+		}
+		return
+	}
+	value, ok = c.waitFetch(key, 0, request, isNew, policy, timeout)
+	return
+}
+
+// SetMaxConcurrentGets limits the number of Get calls (and its variants
+// GetNoPromote, GetE, GetWithPriority, GetRefresh, GetWithFill and
+// GetOrSetFunc) in progress at the same time, including the ones waiting for
+// a fetch, to bound the goroutines blocked in the cache during a stampede.
+// Beyond the limit they fail fast without looking up the key: they return a
+// miss, and GetE returns ErrBusy. Batch gets aren't limited. Zero (default)
+// means no limit. Changing the limit doesn't affect the calls in progress.
+func (c *LRUCache) SetMaxConcurrentGets(n int) {
+	var sem chan struct{}
+	if n > 0 {
+		sem = make(chan struct{}, n)
+	}
+	c.getSem.Store(sem)
+}
+
+// acquireGet takes a slot of the max concurrent gets semaphore without
+// blocking, returns false if there are no free slots. The semaphore must be
+// released with releaseGet.
+func (c *LRUCache) acquireGet() (sem chan struct{}, acquired bool) {
+	sem, _ = c.getSem.Load().(chan struct{})
+	if sem == nil {
+		return nil, true
+	}
+	select {
+	case sem <- struct{}{}:
+		return sem, true
+	default:
+		return nil, false
+	}
+}
+
+// releaseGet frees a slot taken by acquireGet
+func releaseGet(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
+
+// handleMiss looks up a missing key with the miss handler, caching the value
+// unless the key was set while the handler was running. filled is true when
+// the value was cached.
+func (c *LRUCache) handleMiss(key interface{}, handler FetchFunc) (value interface{}, ok bool, filled bool) {
+	if value, ok = handler(key); !ok {
+		return nil, false, false
+	}
+
+	c.Lock()
+	if !c.frozen && !c.oversized(value) {
+		if _, cached := c.cache.Get(key); !cached {
+			_, filled = c.addEntry(key, value)
+		}
+	}
+	c.Unlock()
+	if filled {
+		// The handler value is cached, return a copy
+		value, _ = c.cloneValue(value, true)
+	}
+	return value, true, filled
+}
+
+// GetWithFill is the same as Get, but calls onFill with the key and value
+// when this call's fetch (or miss handler lookup) inserted the value into
+// the cache. Callers that joined a fetch started by another Get, and fetches
+// whose result wasn't cached because the key was Set in the meantime, don't
+// call it, so onFill runs once per fill. It is called without the lock held.
+func (c *LRUCache) GetWithFill(key interface{},
+	onFill func(key, value interface{})) (value interface{}, ok bool) {
+	sem, acquired := c.acquireGet()
+	if !acquired {
+		return nil, false
+	}
+	defer releaseGet(sem)
+	c.Lock()
+	value, ok, request, isNew := c.getLocked(key, true)
+	policy, timeout := c.queuePolicy, c.queueTimeout
+	missHandler := c.missHandler
+	c.Unlock()
+
+	filled := false
+	if request == nil {
+		if !ok && missHandler != nil && c.fetcher == nil {
+			value, ok, filled = c.handleMiss(key, missHandler)
+		}
+	} else {
+		value, ok = c.waitFetch(key, 0, request, isNew, policy, timeout)
+		filled = isNew && request.filled
+	}
+
+	if filled && onFill != nil {
+		onFill(key, value)
+	}
+	return value, ok
+}
+
+// SetMissHandler sets a function used by Get and GetNoPromote to look up the
+// missing keys of a cache without fetch function, the values found are
+// cached. Unlike a fetch function it is called synchronously from the Get
+// goroutine, and concurrent misses for the same key aren't coalesced. It is
+// called without the cache lock held. Ignored by caches with a fetch
+// function.
+func (c *LRUCache) SetMissHandler(handler FetchFunc) {
+	c.Lock()
+	c.missHandler = handler
+	c.Unlock()
+}
+
+// GetWithPriority is the same as Get, but if the key must be fetched the
+// fetch is queued with priority prio (Get uses 0). With WithPriorityQueue
+// the queued fetches with higher priority are served first, otherwise the
+// priority is ignored. Joining a fetch already queued doesn't change its
+// priority.
+func (c *LRUCache) GetWithPriority(key interface{}, prio int) (value interface{}, ok bool) {
+	sem, acquired := c.acquireGet()
+	if !acquired {
+		return nil, false
+	}
+	defer releaseGet(sem)
+	c.Lock()
+	value, ok, request, isNew := c.getLocked(key, true)
+	policy, timeout := c.queuePolicy, c.queueTimeout
+	c.Unlock()
+
+	if request == nil {
+		return
+	}
+	return c.waitFetch(key, prio, request, isNew, policy, timeout)
+}
+
+// waitFetch queues a new fetch request returned by getLocked, and waits
+// until it has finished.
+func (c *LRUCache) waitFetch(key interface{}, prio int, request *fetchRequest, isNew bool,
+	policy QueueFullPolicy, timeout time.Duration) (value interface{}, ok bool) {
+	// Queue key for fetch
+	if isNew && !c.enqueue(key, prio, policy, timeout, nil) {
+		c.cancelRequest(key, request)
+	}
+
+	// Wait until the lookup has finished
+	<-request.ready
+	return c.requestResult(request)
+}
+
+// GetRefresh removes the key from cache and fetches it again, never returning
+// the value that was cached. If the key is already being fetched it waits
+// for that fetch instead of starting a new one, so concurrent refreshes share
+// a single fetch. Without a fetch function it is a Remove that returns a
+// miss. While the cache is frozen it behaves like Get.
+func (c *LRUCache) GetRefresh(key interface{}) (value interface{}, ok bool) {
+	sem, acquired := c.acquireGet()
+	if !acquired {
+		return nil, false
+	}
+	defer releaseGet(sem)
+	c.Lock()
+	if !c.frozen {
+		c.deleteEntry(key)
+	}
+	value, ok, request, isNew := c.getLocked(key, true)
+	policy, timeout := c.queuePolicy, c.queueTimeout
+	c.Unlock()
+
+	if request == nil {
+		return
+	}
+	return c.waitFetch(key, 0, request, isNew, policy, timeout)
+}
+
+// GetE returns the key value like Get, or ErrNotFound if it isn't cached
+// and the fetch function (if any) didn't find it. After Close the misses
+// return ErrClosed, the cached values are still returned. Returns ErrBusy
+// when there are too many concurrent gets (see SetMaxConcurrentGets).
+func (c *LRUCache) GetE(key interface{}) (interface{}, error) {
+	value, ok, busy := c.get(key, true)
+	if ok {
+		return value, nil
+	}
+	if busy {
+		return nil, ErrBusy
+	}
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+	return nil, ErrNotFound
+}
+
+// isClosed returns true after Close or Shutdown
+func (c *LRUCache) isClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
+// GetOrSetFunc returns the key value like Get, but on a miss it calls fn
+// to compute the value and caches it if ok is true, so the computation is
+// only done when needed. Concurrent callers for the same key, including Get
+// calls waiting for a fetch, share a single call to fn. fn is called without
+// the lock held, from the goroutine of the first caller. A Set on the key
+// while fn is running has priority, and its value is returned instead. If
+// fn panics the other callers receive a miss, and the panic propagates to the
+// caller that called fn. Frozen and closed caches return a miss without
+// calling fn.
+func (c *LRUCache) GetOrSetFunc(key interface{},
+	fn func() (interface{}, bool)) (value interface{}, ok bool) {
+	sem, acquired := c.acquireGet()
+	if !acquired {
+		return nil, false
+	}
+	defer releaseGet(sem)
+	c.Lock()
+	if value, ok = c.lookup(key, true); ok {
+		c.Unlock()
+		return
+	}
+	request, isNew := c.joinFetch(key)
+	c.Unlock()
+
+	if request == nil {
+		return nil, false
+	}
+	if isNew {
+		c.fillRequest(key, request, fn)
+	}
+
+	<-request.ready
+	return c.requestResult(request)
+}
+
+// fillRequest completes the fetch request for key with the result of fn. If
+// fn panics the request is completed as a miss before the panic propagates,
+// so the callers waiting for it don't block forever.
+func (c *LRUCache) fillRequest(key interface{}, request *fetchRequest,
+	fn func() (interface{}, bool)) {
+	var value interface{}
+	ok := false
+	defer func() {
+		if !ok {
+			value = nil
+		}
+		ckey := c.coalesceKey(key)
+		c.Lock()
+		if c.fetchM[ckey] == request {
+			c.completeRequest(ckey, request, value, ok)
+		}
+		c.Unlock()
+	}()
+	value, ok = fn()
+}
+
+// GetOrDefault returns the key value like Get, or def if it isn't found
+func (c *LRUCache) GetOrDefault(key interface{}, def interface{}) interface{} {
+	if value, ok := c.Get(key); ok {
+		return value
+	}
+	return def
+}
+
+// GetOrdered gets the values of a batch of keys, returning the results in the
+// same order as the keys. Missing keys are fetched concurrently, and duplicated
+// keys share the same fetch.
+func (c *LRUCache) GetOrdered(keys []interface{}) []Result {
+	results := make([]Result, len(keys))
+	requests := make([]*fetchRequest, len(keys))
+	var queue []int
+
+	c.Lock()
+	for i, key := range keys {
+		value, ok, request, isNew := c.getLocked(key, true)
+		results[i] = Result{Value: value, OK: ok}
+		requests[i] = request
+		if isNew {
+			queue = append(queue, i)
+		}
+	}
+	policy, timeout := c.queuePolicy, c.queueTimeout
+	c.Unlock()
+
+	for _, i := range queue {
+		if !c.enqueue(keys[i], 0, policy, timeout, nil) {
+			c.cancelRequest(keys[i], requests[i])
+		}
+	}
+
+	for i, request := range requests {
+		if request != nil {
+			<-request.ready
+			value, ok := c.requestResult(request)
+			results[i] = Result{Value: value, OK: ok}
+		}
+	}
+	return results
+}
+
+// GetMultiContext gets the values of a batch of keys like GetOrdered, but
+// stops waiting for the missing keys when ctx is done. Returns the values
+// found, and the keys that were abandoned because their fetch didn't finish
+// before ctx was done. Keys not in any of them were resolved as not found.
+//
+// Cached keys and keys whose fetch finished before ctx was done are always
+// resolved. Abandoned fetches keep running and their values are cached when
+// they finish, but fetches that were still waiting for space in the queue
+// are dropped.
+func (c *LRUCache) GetMultiContext(ctx context.Context, keys []interface{}) (
+	values map[interface{}]interface{}, abandoned []interface{}) {
+	values = make(map[interface{}]interface{}, len(keys))
+	requests := make(map[interface{}]*fetchRequest)
+	var queue []interface{}
+
+	c.Lock()
+	for _, key := range keys {
+		if _, seen := requests[key]; seen {
+			continue
+		}
+		value, ok, request, isNew := c.getLocked(key, true)
+		if ok {
+			values[key] = value
+		}
+		if request != nil {
+			requests[key] = request
+			if isNew {
+				queue = append(queue, key)
+			}
+		}
+	}
+	policy, timeout := c.queuePolicy, c.queueTimeout
+	c.Unlock()
+
+	for _, key := range queue {
+		if !c.enqueue(key, 0, policy, timeout, ctx.Done()) {
+			c.cancelRequest(key, requests[key])
+		}
+	}
+
+	for key, request := range requests {
+		select {
+		case <-request.ready:
+		case <-ctx.Done():
+		}
+		select {
+		case <-request.ready:
+			if value, ok := c.requestResult(request); ok {
+				values[key] = value
+			}
+		default:
+			abandoned = append(abandoned, key)
+		}
+	}
+	return values, abandoned
+}
+
+// enqueue sends key to the fetch workers, returns false if it couldn't be
+// queued because of the queue full policy, the cache was closed, or abort
+// was closed (nil never aborts).
+func (c *LRUCache) enqueue(key interface{}, prio int, policy QueueFullPolicy,
+	timeout time.Duration, abort <-chan struct{}) bool {
+	key = c.coalesceKey(key)
+	if !c.sendQueue(key, policy, timeout, abort) {
+		return false
+	}
+	atomic.AddUint64(&c.enqueuedCount, 1)
+	if c.prioQ != nil {
+		// fetchQ only limits the queue size, workers take the keys from prioQ
+		c.prioQ.Push(key, prio)
+	}
+	return true
+}
+
+// sendQueue sends key to fetchQ following the queue full policy
+func (c *LRUCache) sendQueue(key interface{}, policy QueueFullPolicy, timeout time.Duration,
+	abort <-chan struct{}) bool {
+	switch policy {
+	case QueueDrop:
+		select {
+		case c.fetchQ <- key:
+			return true
+		case <-c.done:
+			return false
+		default:
+			atomic.AddUint64(&c.droppedCount, 1)
+			return false
+		}
+	case QueueTimeout:
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case c.fetchQ <- key:
+			return true
+		case <-c.done:
+			return false
+		case <-timer.C:
+			atomic.AddUint64(&c.droppedCount, 1)
+			return false
+		case <-abort:
+			return false
+		}
+	default:
+		select {
+		case c.fetchQ <- key:
+			return true
+		case <-c.done:
+			return false
+		case <-abort:
+			return false
+		}
+	}
+}
+
+// cancelRequest finishes a fetch request that couldn't be queued as a miss,
+// unless it was already finished by a Set call or Close.
+func (c *LRUCache) cancelRequest(key interface{}, request *fetchRequest) {
+	ckey := c.coalesceKey(key)
+	c.Lock()
+	if c.fetchM[ckey] == request {
+		c.finishRequest(ckey, request)
+	}
+	c.Unlock()
+}
+
+// finishRequest removes a request from fetchM and wakes up the goroutines
+// waiting for it. Must be called with the lock held.
+func (c *LRUCache) finishRequest(key interface{}, request *fetchRequest) {
+	delete(c.fetchM, key)
+
+	// Clossing the channel marks the request finished
+	close(request.ready)
+
+	if len(c.fetchM) == 0 && c.drained != nil {
+		close(c.drained)
+		c.drained = nil
+	}
+}
+
+// SetQueueFullPolicy selects what Get does when a key must be fetched but
+// the fetch queue is full: block until there is space, drop the fetch, or
+// wait up to timeout (only used by QueueTimeout). When a fetch is dropped
+// Get returns a miss, and so do the concurrent Get calls for the same key
+// that joined the request while it was waiting for the queue.
+func (c *LRUCache) SetQueueFullPolicy(policy QueueFullPolicy, timeout time.Duration) {
+	c.Lock()
+	c.queuePolicy = policy
+	c.queueTimeout = timeout
+	c.Unlock()
+}
+
+// IsFetching returns true if there is a fetch in progress for key, a Get
+// for the key would wait for it instead of starting a new one.
+func (c *LRUCache) IsFetching(key interface{}) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, fetching := c.fetchM[c.coalesceKey(key)]
+	return fetching
+}
+
+// InflightKeys returns the keys with a fetch in progress, in no particular
+// order, for debugging fetches that don't finish. When fetches are
+// coalesced, every key waiting for a fetch is returned.
+func (c *LRUCache) InflightKeys() []interface{} {
+	c.Lock()
+	defer c.Unlock()
+	keys := make([]interface{}, 0, len(c.fetchM))
+	for _, request := range c.fetchM {
+		keys = append(keys, request.keys...)
+	}
+	return keys
+}
+
+// SetOnFetchComplete sets a function called by the fetch workers after each
+// fetch result is delivered to the waiting Get calls and cached, with the
+// key passed to the fetch function. Fetches whose result was discarded
+// because the key was Set meanwhile aren't reported. It is called without
+// the cache lock held, so it can use the cache, but it delays the worker
+// from serving the next fetch.
+func (c *LRUCache) SetOnFetchComplete(onComplete FetchCompleteFunc) {
+	c.Lock()
+	c.onFetchComplete = onComplete
+	c.Unlock()
+}
+
+// SetSlowFetchThreshold sets the fetch duration above which the fetch is
+// reported to the SetOnSlowFetch callback, zero (default) disables it. Unlike
+// the fetch timeout slow fetches aren't abandoned, their value is cached as
+// usual. The duration is measured like AvgFetchLatency, excluding the time
+// waiting in the fetch queue.
+func (c *LRUCache) SetSlowFetchThreshold(threshold time.Duration) {
+	c.Lock()
+	c.slowThreshold = threshold
+	c.Unlock()
+}
+
+// SetOnSlowFetch sets a function called by the fetch workers with the key
+// and duration of each fetch slower than the SetSlowFetchThreshold, for
+// logging. Like SetOnFetchComplete, it is called without the cache lock
+// held after the result is delivered, and delays the worker from serving
+// the next fetch.
+func (c *LRUCache) SetOnSlowFetch(onSlow SlowFetchFunc) {
+	c.Lock()
+	c.onSlowFetch = onSlow
+	c.Unlock()
+}
+
+// SetMaxWaitersPerKey limits how many Get calls can wait for the fetch of
+// the same key, once there are n callers waiting any further Get for the key
+// returns a miss immediately instead of blocking. It protects against
+// goroutine pileup when a hot key is missing. Zero (default) means no limit.
+func (c *LRUCache) SetMaxWaitersPerKey(n int) {
+	c.Lock()
+	c.maxWaiters = n
+	c.Unlock()
+}
+
+// Do executes fn and returns its results, making sure only one execution is
+// in progress for a key at a time. If there is a call in progress for the key,
+// Do waits for it to finish and returns the same results, and shared is true
+// when the results were handed to more than one caller. The results are not
+// cached, and the keys are independent from the ones being fetched by Get.
+// If fn panics the panic propagates to the caller that executed it, and the
+// callers waiting for it receive ErrPanicked.
+func (c *LRUCache) Do(key interface{}, fn func() (interface{}, error)) (value interface{}, err error, shared bool) {
+	c.Lock()
+	if request, exists := c.callM[key]; exists {
+		request.dups++
+		c.Unlock()
+		<-request.ready
+		return request.value, request.err, true
+	}
+	request := newFetchRequest(key)
+	c.callM[key] = request
+	c.Unlock()
+
+	// Release the waiting callers even if fn panics
+	request.err = ErrPanicked
+	defer func() {
+		c.Lock()
+		delete(c.callM, key)
+		shared = request.dups > 0
+		close(request.ready)
+		c.Unlock()
+	}()
+
+	request.value, request.err = fn()
+	return request.value, request.err, shared
+}
+
+// SetFetchTimeout sets the max duration of a fetch, zero disables the
+// timeout. Each fetch receives a context with the timeout as deadline so the
+// fetch function can abort its own calls, if it returns after the deadline
+// the value is discarded, and the Get calls waiting for it receive a miss.
+// The timeout doesn't include the time waiting in the fetch queue.
+func (c *LRUCache) SetFetchTimeout(timeout time.Duration) {
+	c.Lock()
+	c.fetchTimeout = timeout
+	c.Unlock()
+}
+
+// Set or update key value, returns true if the cache was pruned to make space
+// for a new key. Set has priority over fetched values, so if the key is
+// being fetched, all goroutines waiting will wakeup and receive the 'setted' value
+// while the fetch results are discarded. Values above the max value size
+// are ignored (see SetMaxValueSize).
+func (c *LRUCache) Set(key interface{}, value interface{}) (pruned bool) {
+	lt := c.lockTraced()
+	if !c.frozen && !c.oversized(value) {
+		pruned = c.setLocked(key, value)
+	}
+	c.unlockTraced("Set", lt)
+	return
+}
+
+// setLocked is Set with the lock held
+func (c *LRUCache) setLocked(key interface{}, value interface{}) (pruned bool) {
+	if c.sketch != nil {
+		c.sketch.Increment(key)
+	}
+	_, inCache := c.cache.Get(key)
+	pruned, _ = c.storeLocked(key, value, inCache)
+	c.setDone(key, value, inCache)
+	return
+}
+
+// storeLocked updates the key entry, or inserts it pruning the cache if it
+// is full. Returns false if the key couldn't be inserted (see addEntry),
+// which leaves the cache unchanged. Must be called with the lock held.
+func (c *LRUCache) storeLocked(key interface{}, value interface{}, inCache bool) (pruned bool, stored bool) {
+	if !inCache {
+		return c.addEntry(key, value)
+	}
+	if !c.fifo {
+		c.cache.MoveLast(key)
+	}
+	c.setEntry(key, value)
+	return false, true
+}
+
+// setDone hands the value of a Set to the Get calls waiting for a fetch of
+// the key, and queues it for write-behind. Must be called with the lock held.
+func (c *LRUCache) setDone(key interface{}, value interface{}, inCache bool) {
+	ckey := c.coalesceKey(key)
+	if request, fetching := c.fetchM[ckey]; fetching && !inCache {
+		// In lookup queue (but wasn't in cache)
+		request.value = value
+		request.ok = true
+
+		// All blocked Get methods keep a reference so it can be deleted safely
+		c.finishRequest(ckey, request)
+	}
+
+	if c.writeBehind {
+		c.queueWrite(key, value)
+	}
+}
+
+// SetIfChanged sets the key value like Set, unless the key is already cached
+// with a value equal to value according to eq, in which case the entry is left
+// unchanged and not refreshed. With a nil eq values are compared with ==
+// (values of uncomparable types are always different). Returns true if the
+// value was set.
+func (c *LRUCache) SetIfChanged(key interface{}, value interface{},
+	eq func(a, b interface{}) bool) bool {
+	if eq == nil {
+		eq = sameValue
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.frozen || c.oversized(value) {
+		return false
+	}
+	if old, ok := c.cache.Get(key); ok && eq(old, value) {
+		return false
+	}
+	c.setLocked(key, value)
+	return true
+}
+
+// Increment atomically adds delta to the int64 value of key and returns the
+// new value, the key is set to delta if it isn't cached. The update is a Set,
+// so counters are refreshed and can be evicted like any other entry. Returns
+// false without modifying the cache if the value isn't an int64, or the
+// cache is frozen.
+func (c *LRUCache) Increment(key interface{}, delta int64) (newValue int64, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.frozen {
+		return 0, false
+	}
+
+	newValue = delta
+	if value, cached := c.cache.Get(key); cached {
+		current, isInt := value.(int64)
+		if !isInt {
+			return 0, false
+		}
+		newValue += current
+	}
+	c.setLocked(key, newValue)
+	return newValue, true
+}
+
+// CompareAndSwap sets the key value to new like Set, only if the key is
+// cached and its current value is equal (==) to old. Keys being fetched
+// aren't cached yet so they never match. Values of uncomparable types never
+// match. old is compared with the cached value, not a copy made by
+// WithValueClone, so with cloning enabled pointer values returned by Get
+// never match. Returns true if the value was swapped.
+func (c *LRUCache) CompareAndSwap(key interface{}, old interface{}, new interface{}) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.frozen || c.oversized(new) {
+		return false
+	}
+	if current, ok := c.cache.Get(key); !ok || !sameValue(current, old) {
+		return false
+	}
+	c.setLocked(key, new)
+	return true
+}
+
+// CompareAndDelete removes the key only if it is cached and its current value
+// is equal (==) to old, like CompareAndSwap (see the WithValueClone caveat).
+// Returns true if it was removed.
+func (c *LRUCache) CompareAndDelete(key interface{}, old interface{}) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.frozen {
+		return false
+	}
+	if current, ok := c.cache.Get(key); !ok || !sameValue(current, old) {
+		return false
+	}
+	c.deleteEntry(key)
+	return true
+}
+
+// Put writes the key value to the backing store with the writer function,
+// and only if successful updates the cache with Set. Returns the writer error.
+// Without a writer Put is the same as Set. In write-behind mode Put still
+// writes synchronously, the value isn't queued for the flusher, and a value
+// queued by an earlier Set of the key is dropped so it doesn't overwrite
+// the new one. Returns ErrFrozen without writing the value if the cache is
+// frozen, so the store and the cache don't diverge.
+func (c *LRUCache) Put(key interface{}, value interface{}) error {
+	if c.Frozen() {
+		return ErrFrozen
+	}
+	if c.writer == nil {
+		c.Set(key, value)
+		return nil
+	}
+	if c.writeBehind {
+		// A flush in progress could write an older value after this one
+		c.flushLock.Lock()
+		defer c.flushLock.Unlock()
+	}
+	if err := c.writer(key, value); err != nil {
+		return err
+	}
+
+	c.Lock()
+	if !c.frozen && !c.oversized(value) {
+		c.setLocked(key, value)
+	}
+	if c.writeBehind {
+		delete(c.pendingW, key) // Already written
+	}
+	c.Unlock()
+	return nil
+}
+
+// Remove key from cache
+func (c *LRUCache) Remove(key interface{}) {
+	c.Lock()
+	if !c.frozen {
+		c.deleteEntry(key)
+	}
+	c.Unlock()
+}
+
+// MoveTo atomically removes the key from this cache and sets it in dst, so
+// it is never in both caches or in neither, for promoting and demoting
+// entries between cache tiers. Both caches are locked in a fixed order so
+// concurrent moves in opposite directions don't deadlock. Pins aren't moved.
+// Returns false, leaving both caches unchanged, if the key isn't cached,
+// either cache is frozen, or dst doesn't cache the value (see
+// SetMaxValueSize, Pin and WithAdmissionFilter). Only a successful move is a
+// Set on dst: it is handed to the Gets waiting for a fetch of the key, and
+// queued for write-behind.
+func (c *LRUCache) MoveTo(key interface{}, dst *LRUCache) bool {
+	if dst == c {
+		return c.Contains(key)
+	}
+
+	lockPair(c, dst)
+	defer c.Unlock()
+	defer dst.Unlock()
+
+	if c.frozen || dst.frozen {
+		return false
+	}
+	value, ok := c.cache.Get(key)
+	if !ok || dst.oversized(value) {
+		return false
+	}
+
+	_, inCache := dst.cache.Get(key)
+	if _, stored := dst.storeLocked(key, value, inCache); !stored {
+		return false // Only pinned entries left in dst, or not admitted
+	}
+	if dst.sketch != nil {
+		dst.sketch.Increment(key)
+	}
+	dst.setDone(key, value, inCache)
+	c.cache.Delete(key)
+	c.entryRemoved(key, value)
+	return true
+}
+
+// RemovePrefix removes all the string keys starting with prefix, and returns
+// the number of keys removed. Without WithPrefixIndex it scans the whole cache.
+func (c *LRUCache) RemovePrefix(prefix string) int {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.frozen {
+		return 0
+	}
+
+	var keys []interface{}
+	if c.prefixIndex != nil {
+		for _, key := range c.prefixIndex.Match(prefix) {
+			keys = append(keys, key)
+		}
 	} else {
-		pruned = false
+		for _, key := range c.cache.Keys() {
+			if s, isString := key.(string); isString && strings.HasPrefix(s, prefix) {
+				keys = append(keys, key)
+			}
+		}
 	}
+	return c.deleteEntries(keys)
+}
 
-	// The new value is set after the purge to assure it is not deleted
-	// when the cache size is one, or the prune size is greater than cache size
-	c.cache.Set(key, value)
+// RemoveOldest removes the least recently used item from cache
+func (c *LRUCache) RemoveOldest() {
+	c.Lock()
+	if !c.frozen {
+		if key, value, ok := c.popOldest(); ok {
+			c.discard(key, value)
+		}
+	}
+	c.Unlock()
+}
+
+// RemoveNewest removes the most recently used item from cache
+func (c *LRUCache) RemoveNewest() {
+	c.Lock()
+	if !c.frozen {
+		if key, value, ok := c.popEntry(true); ok {
+			c.discard(key, value)
+		}
+	}
+	c.Unlock()
+}
+
+// PopOldest removes the least recently used item from cache and returns it
+func (c *LRUCache) PopOldest() (key interface{}, value interface{}, ok bool) {
+	c.Lock()
+	if !c.frozen {
+		key, value, ok = c.popOldest()
+	}
 	c.Unlock()
 	return
 }
 
-// Remove key from cache
-func (c *LRUCache) Remove(key interface{}) {
+// PopNewest removes the most recently used item from cache and returns it
+func (c *LRUCache) PopNewest() (key interface{}, value interface{}, ok bool) {
 	c.Lock()
-	c.cache.Delete(key)
+	if !c.frozen {
+		key, value, ok = c.popEntry(true)
+	}
 	c.Unlock()
+	return
 }
 
-// RemoveOldest removes the least recently used item from cache
-func (c *LRUCache) RemoveOldest() {
+// Rank returns the position of key in the recency order, from 0 for the
+// least recently used up to Len()-1 for the most recently used, without
+// updating the cache. It walks the cache so it is O(n), meant for debugging.
+func (c *LRUCache) Rank(key interface{}) (rank int, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, cached := c.cache.Get(key); !cached {
+		return 0, false
+	}
+	for it := c.cache.Iterator(); ; rank++ {
+		k, _, _ := it.Next()
+		if k == key {
+			return rank, true
+		}
+	}
+}
+
+// ToMap returns a copy of the cache contents as a map, losing the LRU order.
+// It is mostly useful in tests.
+func (c *LRUCache) ToMap() map[interface{}]interface{} {
+	c.Lock()
+	defer c.Unlock()
+
+	m := make(map[interface{}]interface{}, c.cache.Len())
+	for it := c.cache.Iterator(); ; {
+		key, value, ok := it.Next()
+		if !ok {
+			break
+		}
+		m[key] = value
+	}
+	return m
+}
+
+// Oldest returns the least recently used item without removing it or
+// updating the cache, in constant time.
+func (c *LRUCache) Oldest() (key interface{}, value interface{}, ok bool) {
+	c.Lock()
+	key, value, ok = c.cache.GetFirst()
+	c.Unlock()
+	return
+}
+
+// Newest returns the most recently used item without removing it or
+// updating the cache, in constant time.
+func (c *LRUCache) Newest() (key interface{}, value interface{}, ok bool) {
 	c.Lock()
-	c.cache.PopFirst()
+	key, value, ok = c.cache.GetLast()
 	c.Unlock()
+	return
 }
 
-// RemoveNewest removes the most recently used item from cache
-func (c *LRUCache) RemoveNewest() {
+// OldestN returns up to n of the least recently used entries, from the
+// oldest, without updating the cache. Only the returned entries are walked.
+func (c *LRUCache) OldestN(n int) []Entry {
+	c.Lock()
+	defer c.Unlock()
+	return c.walkN(c.cache.Iterator(), n)
+}
+
+// NewestN returns up to n of the most recently used entries, from the
+// newest, without updating the cache. Only the returned entries are walked.
+func (c *LRUCache) NewestN(n int) []Entry {
+	c.Lock()
+	defer c.Unlock()
+	return c.walkN(c.cache.ReverseIterator(), n)
+}
+
+// walkN returns the first n entries returned by the iterator
+func (c *LRUCache) walkN(it *orderedmap.Iterator, n int) []Entry {
+	if n > c.cache.Len() {
+		n = c.cache.Len()
+	}
+	if n <= 0 {
+		return nil
+	}
+	entries := make([]Entry, 0, n)
+	for len(entries) < n {
+		key, value, _ := it.Next()
+		entries = append(entries, Entry{key, value})
+	}
+	return entries
+}
+
+// SetMinResidency protects the entries inserted less than d ago from being
+// evicted, pruning skips them and evicts the next eligible entries instead.
+// It enables insertion time tracking (see WithAgeTracking), the entries
+// cached before enabling it aren't protected. Pinned entries count as
+// protected too, so if the cache is full and all the entries are protected
+// new keys are not cached, like when all the entries are pinned. Zero
+// disables the protection.
+func (c *LRUCache) SetMinResidency(d time.Duration) {
+	c.Lock()
+	c.minResidency = d
+	if d > 0 && c.inserted == nil {
+		c.inserted = make(map[interface{}]time.Time)
+	}
+	c.Unlock()
+}
+
+// SetMaxValueSize sets the max size in bytes of a cached value, measured with
+// the weigh function, or the length for []byte values when there is none.
+// Set, SetIfChanged and CompareAndSwap ignore oversized values returning
+// false, and SwapContents skips them. Oversized values returned by the fetch
+// function are passed to the waiting Gets but not cached, so every Get for
+// the key fetches it again. Zero disables the limit.
+func (c *LRUCache) SetMaxValueSize(bytes int64) {
+	c.Lock()
+	c.maxValueSize = bytes
+	c.Unlock()
+}
+
+// oversized returns true if the value is above the max value size, or weighs
+// more than the whole cache. Must be called with the lock held.
+func (c *LRUCache) oversized(value interface{}) bool {
+	if c.maxWeight > 0 && c.weigher(value) > c.maxWeight {
+		return true
+	}
+	if c.maxValueSize <= 0 {
+		return false
+	}
+	if c.weigher != nil {
+		return c.weigher(value) > c.maxValueSize
+	}
+	b, isBytes := value.([]byte)
+	return isBytes && int64(len(b)) > c.maxValueSize
+}
+
+// SetOnFull sets a function called the first time the cache is pruned to make
+// space for a new key after being below capacity. It isn't called again until
+// an entry is removed (other than by pruning), the cache is purged or resized
+// to a larger size. It is called with the cache locked so it must not call
+// any cache method.
+func (c *LRUCache) SetOnFull(onFull func()) {
 	c.Lock()
-	c.cache.PopLast()
+	c.onFull = onFull
 	c.Unlock()
 }
 
+// Pin marks a cached key so it is never pruned or removed by RemoveOldest
+// and PopOldest, returns false if the key isn't cached. Pinned keys still
+// count toward the cache size, if the cache is full and all the keys are
+// pinned new keys are rejected (not cached) until there is space again.
+// Pinned keys are still removed by Remove, RemoveNewest, PopNewest and Purge.
+func (c *LRUCache) Pin(key interface{}) bool {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.cache.Get(key); !ok {
+		return false
+	}
+	c.pinned[key] = struct{}{}
+	return true
+}
+
+// Unpin removes the pin from a key, returns false if the key wasn't pinned
+func (c *LRUCache) Unpin(key interface{}) bool {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.pinned[key]; !ok {
+		return false
+	}
+	delete(c.pinned, key)
+	return true
+}
+
+// lockPair locks two caches always in the same order (by id) to avoid
+// deadlocks, every operation locking two caches must use it.
+func lockPair(a *LRUCache, b *LRUCache) {
+	if a.id > b.id {
+		a, b = b, a
+	}
+	a.Lock()
+	b.Lock()
+}
+
+// Equal returns true if both caches contain the same keys in the same LRU
+// order, and their values are deeply equal (see reflect.DeepEqual). Stats,
+// fetchers and settings are ignored.
+func (c *LRUCache) Equal(other *LRUCache) bool {
+	if c == other {
+		return true
+	}
+
+	lockPair(c, other)
+	defer c.Unlock()
+	defer other.Unlock()
+
+	if c.cache.Len() != other.cache.Len() {
+		return false
+	}
+
+	it, otherIt := c.cache.Iterator(), other.cache.Iterator()
+	for {
+		key, value, ok := it.Next()
+		otherKey, otherValue, _ := otherIt.Next()
+		if !ok {
+			return true
+		}
+		if key != otherKey || !reflect.DeepEqual(value, otherValue) {
+			return false
+		}
+	}
+}
+
 // Peek allows to get an itme value without updating the cache, stats,
 // or triggering a fetch
 func (c *LRUCache) Peek(key interface{}) (value interface{}, ok bool) {
 	c.Lock()
-	value, ok = c.cache.Get(key)
+	value, ok = c.cloneValue(c.cache.Get(key))
 	c.Unlock()
 	return
 }
 
 // Contains returns true if the cache contains the key (no side-effects)
 func (c *LRUCache) Contains(key interface{}) bool {
-	_, ok := c.Peek(key)
+	c.Lock()
+	_, ok := c.cache.Get(key)
+	c.Unlock()
 	return ok
 }
 
@@ -329,16 +2210,262 @@ func (c *LRUCache) Contains(key interface{}) bool {
 // being fetched are not purged.
 func (c *LRUCache) Purge() {
 	c.Lock()
-	c.cache = orderedmap.NewOrderedMap(c.size)
+	if !c.frozen {
+		c.purge()
+	}
+	c.Unlock()
+}
+
+// PurgeAll purges all cache contents like Purge, and also invalidates the
+// fetches in progress. The Get calls waiting for them return a miss, and
+// their values are discarded when the fetch finishes, so no value fetched
+// before the purge is cached after it.
+func (c *LRUCache) PurgeAll() {
+	c.Lock()
+	if !c.frozen {
+		c.purge()
+		for ckey, request := range c.fetchM {
+			c.finishRequest(ckey, request)
+		}
+	}
+	c.Unlock()
+}
+
+// purge is Purge with the lock held
+func (c *LRUCache) purge() {
+	old := c.reset()
+	c.purgeCount++
+	c.purgedCount += uint64(old.Len())
+	if c.autoClose {
+		for it := old.Iterator(); ; {
+			key, value, ok := it.Next()
+			if !ok {
+				break
+			}
+			c.discard(key, value)
+		}
+	}
+}
+
+// reset replaces the cache map with an empty one, clearing all the entries
+// bookkeeping, and returns the old map.
+func (c *LRUCache) reset() (old *orderedmap.OrderedMap) {
+	old = c.cache
+	c.cache = orderedmap.NewOrderedMap(c.cache.Cap())
+	if c.prefixIndex != nil {
+		c.prefixIndex = newPrefixIndex()
+	}
+	if c.tags != nil {
+		c.tags = newTagIndex()
+	}
+	if c.interned != nil {
+		c.interned = newInternTable(c.interned.hash, c.interned.equal)
+	}
+	c.weight = 0
+	c.pinned = make(map[interface{}]struct{})
+	if c.inserted != nil {
+		c.inserted = make(map[interface{}]time.Time)
+	}
+	if c.lastAccess != nil {
+		c.lastAccess = make(map[interface{}]time.Time)
+	}
+	if c.accessed != nil {
+		c.accessed = make(map[interface{}]uint64)
+	}
+	c.saturated = false
+	return old
+}
+
+// Entry is a cached key value pair
+type Entry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// SwapContents atomically replaces all the cache contents with entries,
+// ordered from the least to the most recently used. If there are more
+// entries than the cache size only the last ones are kept, and when a key
+// is repeated the last value is used. Fetches in progress aren't affected,
+// their values are cached in the new contents when they finish, unless the
+// new contents already have the key. Ignored while the cache is frozen.
+func (c *LRUCache) SwapContents(entries []Entry) {
+	c.Lock()
+	defer c.Unlock()
+	if c.frozen {
+		return
+	}
+
+	if len(entries) > c.size {
+		entries = entries[len(entries)-c.size:]
+	}
+	old := c.reset()
+	for _, e := range entries {
+		if c.oversized(e.Value) {
+			continue
+		}
+		c.setEntry(e.Key, e.Value)
+		c.cache.MoveLast(e.Key)
+	}
+
+	if c.autoClose {
+		// Close the old values not kept in the new contents
+		for it := old.Iterator(); ; {
+			key, value, ok := it.Next()
+			if !ok {
+				break
+			}
+			if current, cached := c.cache.Get(key); !cached || !sameValue(current, value) {
+				c.discard(key, value)
+			}
+		}
+	}
+}
+
+// Freeze makes the cache read-only. While frozen Set, Remove, Pop, Purge
+// and Resize calls are ignored, Put returns ErrFrozen, Get doesn't refresh the accessed keys nor
+// fetch missing ones, and values fetched before freezing aren't cached.
+// Get, Peek and Contains keep working so the cache can be safely copied
+// or swapped while in use.
+func (c *LRUCache) Freeze() {
+	c.Lock()
+	c.frozen = true
+	c.Unlock()
+}
+
+// Unfreeze restores a frozen cache to normal operation
+func (c *LRUCache) Unfreeze() {
+	c.Lock()
+	c.frozen = false
 	c.Unlock()
 }
 
-// Close stops all fetch routines
+// Frozen returns true if the cache is frozen
+func (c *LRUCache) Frozen() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.frozen
+}
+
+// goInvalidateFunc is the goroutine removing the keys received from InvalidateChan
+func (c *LRUCache) goInvalidateFunc() {
+	defer c.wg.Done()
+	for {
+		select {
+		case key := <-c.invalidateQ:
+			c.Remove(key)
+		case <-c.done:
+			// Drain invalidations queued before Close
+			for {
+				select {
+				case key := <-c.invalidateQ:
+					c.Remove(key)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// InvalidateChan returns a channel where keys can be sent to be removed
+// asynchronously from the cache, so invalidation producers aren't blocked
+// by the cache lock. Keys already queued when the cache is closed are
+// removed, but the channel must not be used after Close.
+func (c *LRUCache) InvalidateChan() chan<- interface{} {
+	c.Lock()
+	defer c.Unlock()
+	if c.invalidateQ == nil {
+		c.invalidateQ = make(chan interface{}, invalidateQueueSize)
+		c.wg.Add(1)
+		go c.goInvalidateFunc()
+	}
+	return c.invalidateQ
+}
+
+// Close stops all fetch, invalidation and flush routines. Fetches in progress
+// are allowed to finish, while Get calls waiting for a fetch that wasn't
+// started receive a miss. After Close, Get doesn't fetch missing keys.
+// In write-behind mode Close flushes the queued values once, values that
+// fail to be written are discarded. Calling Close more than once is safe.
 func (c *LRUCache) Close() {
 	c.Lock()
-	close(c.fetchQ)
+	if c.closed {
+		c.Unlock()
+		return
+	}
+	c.closed = true
+	c.Unlock()
+	c.stop(true)
+}
+
+// Shutdown gracefully closes the cache, it stops accepting new fetches and
+// waits until the fetches already requested are finished before closing
+// (see Close). If ctx expires before that, the background routines are
+// signaled to exit without waiting for them, the Get calls still waiting
+// receive a miss, write-behind values aren't flushed, and the context error
+// is returned.
+func (c *LRUCache) Shutdown(ctx context.Context) error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return nil
+	}
+	c.closed = true
+	drained := c.waitDrained()
+	c.Unlock()
+
+	select {
+	case <-drained:
+		c.stop(true)
+		return nil
+	case <-ctx.Done():
+		c.stop(false)
+		return ctx.Err()
+	}
+}
+
+// WaitIdle blocks until there are no fetches queued or in progress. Fetches
+// requested while waiting delay the return, but it doesn't wait for fetches
+// requested after it returns, so the cache may be busy again by then.
+func (c *LRUCache) WaitIdle() {
+	c.Lock()
+	drained := c.waitDrained()
+	c.Unlock()
+	<-drained
+}
+
+// waitDrained returns a channel closed when fetchM becomes empty, already
+// closed if it is. Must be called with the lock held.
+func (c *LRUCache) waitDrained() <-chan struct{} {
+	if len(c.fetchM) == 0 {
+		drained := make(chan struct{})
+		close(drained)
+		return drained
+	}
+	if c.drained == nil {
+		c.drained = make(chan struct{})
+	}
+	return c.drained
+}
+
+// stop signals the background routines to exit, and fails the fetch requests
+// left. If wait is true it waits for the routines and flushes write-behind values.
+func (c *LRUCache) stop(wait bool) {
+	c.Lock()
+	close(c.done)
+	c.Unlock()
+
+	if wait {
+		c.wg.Wait()
+		c.Flush()
+	}
+
+	// Fail requests left in the queue when the workers exited
+	c.Lock()
+	for key, request := range c.fetchM {
+		c.finishRequest(key, request)
+	}
 	c.Unlock()
-	c.wg.Wait()
 }
 
 // Stats returns cache hit and miss stats since the last reset
@@ -349,17 +2476,150 @@ func (c *LRUCache) Stats() (hit uint64, miss uint64) {
 	return
 }
 
-// ResetStats set stats to 0
+// Metrics is a snapshot of the cache counters
+type Metrics struct {
+	// Cache name, see WithName
+	Name string
+
+	Hits   uint64
+	Misses uint64
+
+	// Number of fetch function calls, and total time spent on them
+	Fetches   uint64
+	FetchTime time.Duration
+
+	// Number of Purge and PurgeAll calls, and entries discarded by them
+	Purges        uint64
+	PurgedEntries uint64
+
+	// Number of fetches queued, and dropped because the fetch queue was
+	// full (with QueueDrop, or QueueTimeout after the timeout expired)
+	Enqueued uint64
+	Dropped  uint64
+}
+
+// Metrics returns the current cache counters, ResetStats only resets hits
+// and misses.
+func (c *LRUCache) Metrics() Metrics {
+	c.Lock()
+	hits, misses := c.hitCount, c.missCount
+	purges, purged := c.purgeCount, c.purgedCount
+	c.Unlock()
+	return Metrics{
+		Name:          c.name,
+		Hits:          hits,
+		Misses:        misses,
+		Fetches:       atomic.LoadUint64(&c.fetchCount),
+		FetchTime:     time.Duration(atomic.LoadInt64(&c.fetchNanos)),
+		Purges:        purges,
+		PurgedEntries: purged,
+		Enqueued:      atomic.LoadUint64(&c.enqueuedCount),
+		Dropped:       atomic.LoadUint64(&c.droppedCount),
+	}
+}
+
+// AvgFetchLatency returns the average duration of the fetch function calls
+func (c *LRUCache) AvgFetchLatency() time.Duration {
+	m := c.Metrics()
+	if m.Fetches == 0 {
+		return 0
+	}
+	return m.FetchTime / time.Duration(m.Fetches)
+}
+
+// RecentHitRatio returns the ratio of Get calls that were hits over the
+// window set with WithRecentHitRatio, it reacts to workload changes faster
+// than the ratio from Stats. Without WithRecentHitRatio it returns the ratio
+// since the stats were last reset. Returns 0 if there were no Get calls.
+func (c *LRUCache) RecentHitRatio() float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	hits, misses := c.hitCount, c.missCount
+	if c.recentHits != nil {
+		now := time.Now()
+		hits, misses = c.recentHits.Sum(now), c.recentMisses.Sum(now)
+	}
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// ResetStats set stats to 0, including the recent hits and misses (see
+// RecentHitRatio)
 func (c *LRUCache) ResetStats() {
 	c.Lock()
+	c.resetStats()
+	c.Unlock()
+}
+
+// SnapshotStats returns the hit and miss counts and resets them atomically,
+// so no counts are lost between reading and resetting them. Like ResetStats
+// the recent hits and misses are reset too.
+func (c *LRUCache) SnapshotStats() (hit uint64, miss uint64) {
+	c.Lock()
+	hit, miss = c.hitCount, c.missCount
+	c.resetStats()
+	c.Unlock()
+	return
+}
+
+// resetStats sets the hit and miss counts to 0. Must be called with the lock
+// held.
+func (c *LRUCache) resetStats() {
 	c.hitCount = 0
 	c.missCount = 0
-	c.Unlock()
+	if c.recentHits != nil {
+		c.recentHits.Reset()
+		c.recentMisses.Reset()
+	}
 }
 
 // Stringer interface
 func (c *LRUCache) String() string {
 	c.Lock()
 	defer c.Unlock()
+	return c.describe()
+}
+
+// describe returns the String description. Must be called with the lock held.
+func (c *LRUCache) describe() string {
+	if c.name != "" {
+		return fmt.Sprintf("LRUCache(%q, %v, %v)", c.name, c.size, c.cache.Len())
+	}
 	return fmt.Sprintf("LRUCache(%v, %v)", c.size, c.cache.Len())
 }
+
+// Name returns the cache name set with WithName, empty if it has none
+func (c *LRUCache) Name() string {
+	return c.name
+}
+
+// Dump returns the String description followed by the cached keys from the
+// least to the most recently used, for debugging. Only the first dumpMaxKeys
+// keys are listed.
+func (c *LRUCache) Dump() string {
+	c.Lock()
+	defer c.Unlock()
+
+	var b strings.Builder
+	b.WriteString(c.describe())
+	b.WriteString("[")
+	it := c.cache.Iterator()
+	for i := 0; i < dumpMaxKeys; i++ {
+		key, _, ok := it.Next()
+		if !ok {
+			break
+		}
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		fmt.Fprint(&b, key)
+	}
+	if c.cache.Len() > dumpMaxKeys {
+		fmt.Fprintf(&b, " ...%v more", c.cache.Len()-dumpMaxKeys)
+	}
+	b.WriteString("]")
+	return b.String()
+}
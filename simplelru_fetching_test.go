@@ -1,8 +1,11 @@
 package simplelru
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -590,34 +593,1363 @@ func TestSetBeforeFetching(t *testing.T) {
 
 	storage := newStorage(1000)
 
-	// fetch func has random 0-9ms delay
 	fetcher := func(key interface{}) (value interface{}, ok bool) {
-		time.Sleep(50 * time.Millisecond)
 		value, ok = storage.Get(key)
 		return
 	}
 
-	cache := NewFetchingLRUCache(1000, 10, fetcher, 1, 100)
+	// The single worker is held before fetching the first key
+	before := newSeam()
+	completed := make(notifier, 10)
+	cache := NewFetchingLRUCache(1000, 10, fetcher, 1, 100,
+		withWorkerHooks(workerHooks{beforeFetch: before.hook, afterComplete: completed.hook}))
 
-	concurrentGet := func(cache *LRUCache, key interface{}, result *interface{}, delay int) {
-		time.Sleep(time.Duration(delay) * time.Millisecond)
-		*result, _ = cache.Get(key)
+	concurrentGet := func(cache *LRUCache, key interface{}, result chan interface{}) {
+		value, _ := cache.Get(key)
+		result <- value
 	}
 
-	//
-	var result1 interface{}
-	var result2 interface{}
-	go concurrentGet(cache, 44, &result1, 1)
-	go concurrentGet(cache, 33, &result2, 10) // This will queued
-	time.Sleep(20 * time.Millisecond)
+	result1 := make(chan interface{})
+	result2 := make(chan interface{})
+	go concurrentGet(cache, 44, result1)
+	<-before.reached
+	go concurrentGet(cache, 33, result2) // This will queued
+	for !cache.IsFetching(33) {
+		time.Sleep(time.Millisecond)
+	}
 	cache.Set(33, 100) // This is set before second fetch starts
 
-	time.Sleep(200 * time.Millisecond)
-	if result2 != 100 {
-		t.Error("Fetch ignored Set() value", result1)
+	if result := <-result2; result != 100 {
+		t.Error("Fetch ignored Set() value", result)
 	}
 
-	if result1 != 44 {
+	close(before.release)
+	if result := <-result1; result != 44 {
 		t.Error("First fetch failed")
 	}
+	if <-completed != 44 || storage.CallCount() != 1 {
+		t.Error("The key set was fetched")
+	}
+	cache.Close()
+}
+
+// Test Key is set after the fetch function returned, but before the worker
+// processed the result
+func TestSetAfterFetching(t *testing.T) {
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		return "fetched", true
+	}
+
+	after := newSeam()
+	completed := make(notifier, 10)
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 10,
+		withWorkerHooks(workerHooks{afterFetch: after.hook, afterComplete: completed.hook}))
+
+	result := make(chan interface{})
+	go func() {
+		value, _ := cache.Get(1)
+		result <- value
+	}()
+	<-after.reached
+
+	cache.Set(1, "set")
+	if value := <-result; value != "set" {
+		t.Error(fmt.Sprintf("Get returned %v expecting set", value))
+	}
+
+	close(after.release)
+	<-completed
+	if value, _ := cache.Peek(1); value != "set" {
+		t.Error(fmt.Sprintf("The fetched value overwrote the Set value: %v", value))
+	}
+	cache.Close()
+}
+
+// Test Set on a key while its fetch is running hands the value to the
+// waiting Gets, and the worker discards the fetched value without touching
+// the finished request.
+func TestSetDuringFetch(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var fetches int32
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		n := atomic.AddInt32(&fetches, 1)
+		started <- struct{}{}
+		<-release
+		return fmt.Sprintf("fetched%v", n), true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 10)
+	result := make(chan interface{})
+	go func() {
+		value, _ := cache.Get(1)
+		result <- value
+	}()
+	<-started
+
+	cache.Set(1, "set")
+	if value := <-result; value != "set" {
+		t.Error(fmt.Sprintf("Get returned %v expecting the Set value", value))
+	}
+
+	// A new fetch for the same key while the first one is still running
+	cache.Remove(1)
+	go func() {
+		value, _ := cache.Get(1)
+		result <- value
+	}()
+	for !cache.IsFetching(1) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The first fetch finishes, its value must not finish the new request
+	close(release)
+	<-started
+	if value := <-result; value != "fetched2" {
+		t.Error(fmt.Sprintf("Get returned %v expecting fetched2", value))
+	}
+	if value, _ := cache.Peek(1); value != "fetched2" {
+		t.Error("The second fetch value wasn't cached")
+	}
+	cache.Close()
+}
+
+// Stress Set racing with fetch completion, it must never panic closing a
+// request twice, and Get always returns either the Set or fetched value.
+func TestSetFetchRace(t *testing.T) {
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		return key, true
+	}
+
+	cache := NewFetchingLRUCache(8, 1, fetcher, 4, 100)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := i % 16
+				switch (g + i) % 3 {
+				case 0:
+					cache.Set(key, key)
+				case 1:
+					cache.Remove(key)
+				default:
+					if value, ok := cache.Get(key); !ok || value != key {
+						t.Error(fmt.Sprintf("Get(%v) returned %v %v", key, value, ok))
+						return
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	cache.Close()
+}
+
+// Test values cached while a fetch is running have priority over the
+// fetched value. A single worker serializes the fetches, so when a second
+// fetch finishes the first one has been completely processed.
+func TestSetPriorityOverFetch(t *testing.T) {
+	started := make(chan interface{})
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		if key != "sync" {
+			started <- key
+			<-release
+		}
+		return "fetched", true
+	}
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 10)
+
+	// waitWorker blocks until the previous fetches were processed
+	waitWorker := func() {
+		cache.Remove("sync")
+		cache.Get("sync")
+	}
+
+	// Set while the fetch is running
+	result := make(chan interface{})
+	go func() {
+		value, _ := cache.Get(1)
+		result <- value
+	}()
+	<-started
+	cache.Set(1, "set")
+	if value := <-result; value != "set" {
+		t.Error(fmt.Sprintf("Get returned %v expecting set", value))
+	}
+	release <- struct{}{}
+	waitWorker()
+	if value, _ := cache.Peek(1); value != "set" {
+		t.Error(fmt.Sprintf("The fetched value overwrote the Set value: %v", value))
+	}
+
+	// Contents swapped while the fetch is running
+	go func() {
+		value, _ := cache.Get(2)
+		result <- value
+	}()
+	<-started
+	cache.SwapContents([]Entry{{2, "swapped"}})
+	release <- struct{}{}
+	if value := <-result; value != "fetched" {
+		t.Error(fmt.Sprintf("Get returned %v expecting fetched", value))
+	}
+	waitWorker()
+	if value, _ := cache.Peek(2); value != "swapped" {
+		t.Error(fmt.Sprintf("The fetched value overwrote the swapped value: %v", value))
+	}
+
+	// Set, Remove and fetch again while the first fetch is running
+	go func() {
+		cache.Get(3)
+	}()
+	<-started
+	cache.Set(3, "set")
+	cache.Remove(3)
+	go func() {
+		value, _ := cache.Get(3)
+		result <- value
+	}()
+	for !cache.IsFetching(3) {
+		time.Sleep(time.Millisecond)
+	}
+	cache.Set(3, "set again")
+	if value := <-result; value != "set again" {
+		t.Error(fmt.Sprintf("Get returned %v expecting set again", value))
+	}
+	release <- struct{}{} // The second request is never fetched
+	waitWorker()
+	if value, _ := cache.Peek(3); value != "set again" {
+		t.Error(fmt.Sprintf("An old fetch overwrote the Set value: %v", value))
+	}
+	cache.Close()
+}
+
+// Test a frozen cache doesn't fetch missing keys
+func TestFrozenFetch(t *testing.T) {
+	storage := newStorage(1000)
+
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		return storage.Get(key)
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 10)
+	cache.Freeze()
+
+	if _, ok := cache.Get(1); ok || storage.CallCount() != 0 {
+		t.Error("A frozen cache fetched a missing key")
+	}
+
+	cache.Unfreeze()
+	if value, ok := cache.Get(1); !ok || value != 1 || storage.CallCount() != 1 {
+		t.Error("Unfreeze didn't restore fetching")
+	}
+
+	cache.Close()
+}
+
+// Test the queue full policies
+func TestQueueFullPolicy(t *testing.T) {
+	storage := newStorage(1000)
+
+	// fetch func blocks until release is closed
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		<-release
+		return storage.Get(key)
+	}
+
+	// One worker and a queue of one, so the queue is full after two fetches
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 1)
+
+	var wg sync.WaitGroup
+	concurrentGet := func(cache *LRUCache, key interface{}) {
+		defer wg.Done()
+		cache.Get(key)
+	}
+	wg.Add(2)
+	go concurrentGet(cache, 1) // Blocks the worker
+	time.Sleep(20 * time.Millisecond)
+	go concurrentGet(cache, 2) // Fills the queue
+	time.Sleep(20 * time.Millisecond)
+
+	// Drop
+	cache.SetQueueFullPolicy(QueueDrop, 0)
+	if _, ok := cache.Get(3); ok {
+		t.Error("Dropped fetch should have returned a miss")
+	}
+
+	// Timeout
+	cache.SetQueueFullPolicy(QueueTimeout, 50*time.Millisecond)
+	start := time.Now()
+	if _, ok := cache.Get(4); ok {
+		t.Error("Timed out fetch should have returned a miss")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Get returned before the queue timeout")
+	}
+
+	// Failed requests are not left in fetchM
+	cache.Lock()
+	_, ok3 := cache.fetchM[3]
+	_, ok4 := cache.fetchM[4]
+	cache.Unlock()
+	if ok3 || ok4 {
+		t.Error("Failed fetch requests weren't removed from fetchM")
+	}
+
+	if m := cache.Metrics(); m.Enqueued != 2 || m.Dropped != 2 {
+		t.Error(fmt.Sprintf("Expected 2 enqueued and 2 dropped, got %v %v", m.Enqueued, m.Dropped))
+	}
+
+	close(release)
+	wg.Wait()
+
+	// Once there is space in the queue fetching works again
+	if value, ok := cache.Get(3); !ok || value != 3 {
+		t.Error("Fetch failed after the queue was emptied")
+	}
+	if m := cache.Metrics(); m.Enqueued != 3 || m.Dropped != 2 {
+		t.Error(fmt.Sprintf("Expected 3 enqueued and 2 dropped, got %v %v", m.Enqueued, m.Dropped))
+	}
+
+	cache.Close()
+}
+
+// Test Close finishes all pending requests, including the ones waiting
+// for space in the fetch queue.
+func TestCloseWithFullQueue(t *testing.T) {
+	storage := newStorage(1000)
+
+	// fetch func blocks until release is closed
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		<-release
+		return storage.Get(key)
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 1)
+
+	var wg sync.WaitGroup
+	concurrentGet := func(cache *LRUCache, key interface{}) {
+		defer wg.Done()
+		cache.Get(key)
+	}
+
+	// The first key blocks the worker, the second fills the queue and
+	// the rest wait for space in the queue.
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go concurrentGet(cache, i)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		cache.Close()
+		close(closed)
+	}()
+
+	// Gets waiting for queue space return as soon as the cache is closed
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	<-closed
+
+	cache.Lock()
+	pending := len(cache.fetchM)
+	cache.Unlock()
+	if pending != 0 {
+		t.Error(fmt.Sprintf("%v fetch requests leaked after Close", pending))
+	}
+
+	// Get after Close is a miss, without blocking or fetching
+	storage.ResetCallCount()
+	if _, ok := cache.Get(100); ok || storage.CallCount() != 0 {
+		t.Error("Get fetched a key after Close")
+	}
+
+	// Close is idempotent
+	cache.Close()
+}
+
+// Test the fetch timeout is passed to the fetcher as a context deadline
+func TestFetchTimeout(t *testing.T) {
+	storage := newStorage(1000)
+
+	// Keys over 100 are slow, and abort on context cancelation
+	fetcher := func(ctx context.Context, key interface{}) (value interface{}, ok bool) {
+		if key.(int) > 100 {
+			<-ctx.Done()
+			return key, true
+		}
+		if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+			return nil, false
+		}
+		return storage.Get(key)
+	}
+
+	cache := NewContextFetchingLRUCache(100, 10, fetcher, 1, 10)
+	cache.SetFetchTimeout(50 * time.Millisecond)
+
+	if value, ok := cache.Get(1); !ok || value != 1 {
+		t.Error("Fetch didn't receive a context with deadline")
+	}
+
+	// Values returned after the deadline are discarded
+	start := time.Now()
+	if _, ok := cache.Get(200); ok {
+		t.Error("Timed out fetch should have returned a miss")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Fetch was canceled before the timeout")
+	}
+	if cache.Contains(200) {
+		t.Error("Timed out fetch value was cached")
+	}
+
+	cache.Close()
+}
+
+// Test GetOrdered returns results in the same order as the keys
+func TestGetOrdered(t *testing.T) {
+	storage := newStorage(1000)
+
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		time.Sleep(20 * time.Millisecond)
+		return storage.Get(key)
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 4, 10)
+	cache.Set(2, "cached")
+
+	keys := []interface{}{1, 2, 3, 1, 5000, 3}
+	results := cache.GetOrdered(keys)
+
+	expected := []Result{{1, true}, {"cached", true}, {3, true}, {1, true},
+		{nil, false}, {3, true}}
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Error(fmt.Sprintf("Result %v: expected %v received %v", i,
+				expected[i], results[i]))
+		}
+	}
+
+	// Duplicated keys share a fetch
+	if calls := storage.CallCount(); calls != 3 {
+		t.Error(fmt.Sprintf("Expected 3 fetches, there were %v", calls))
+	}
+
+	if hit, miss := cache.Stats(); hit != 1 || miss != 5 {
+		t.Error("Stat accounting error")
+	}
+
+	if results := cache.GetOrdered(nil); len(results) != 0 {
+		t.Error("GetOrdered with no keys should return no results")
+	}
+
+	cache.Close()
+}
+
+// Test GetMultiContext returns partial results when the context is done
+func TestGetMultiContext(t *testing.T) {
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		if key == "slow" {
+			<-release
+		}
+		if key == "missing" {
+			return nil, false
+		}
+		return key, true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 4, 10)
+	cache.Set("cached", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	keys := []interface{}{"cached", "fast", "slow", "missing", "fast"}
+	values, abandoned := cache.GetMultiContext(ctx, keys)
+
+	if len(values) != 2 || values["cached"] != 1 || values["fast"] != "fast" {
+		t.Error(fmt.Sprintf("Unexpected values %v", values))
+	}
+	if len(abandoned) != 1 || abandoned[0] != "slow" {
+		t.Error(fmt.Sprintf("Unexpected abandoned keys %v", abandoned))
+	}
+
+	// The abandoned fetch is cached when it finishes
+	close(release)
+	if value, ok := cache.Get("slow"); !ok || value != "slow" {
+		t.Error("Abandoned fetch wasn't cached")
+	}
+
+	// Without cancellation all the keys are resolved
+	values, abandoned = cache.GetMultiContext(context.Background(), keys)
+	if len(values) != 3 || len(abandoned) != 0 {
+		t.Error(fmt.Sprintf("Unexpected results %v %v", values, abandoned))
+	}
+
+	cache.Close()
+}
+
+// Test GetRefresh fetches cached keys again
+func TestGetRefresh(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		<-release
+		return atomic.AddInt32(&fetches, 1), true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 4, 10)
+	cache.Set("key", "stale")
+
+	// Concurrent refreshes share the fetch
+	var wg sync.WaitGroup
+	results := make(chan interface{}, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, _ := cache.GetRefresh("key")
+			results <- value
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if cache.Contains("key") {
+		t.Error("GetRefresh didn't remove the cached value")
+	}
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for value := range results {
+		if value != int32(1) {
+			t.Error(fmt.Sprintf("GetRefresh returned %v expecting 1", value))
+		}
+	}
+	if value, _ := cache.Get("key"); value != int32(1) {
+		t.Error("The refreshed value wasn't cached")
+	}
+
+	// Fetches again even if cached
+	if value, _ := cache.GetRefresh("key"); value != int32(2) {
+		t.Error(fmt.Sprintf("GetRefresh returned %v expecting 2", value))
+	}
+	cache.Close()
+
+	// Without fetcher it is a Remove
+	simple := NewLRUCache(10, 1)
+	simple.Set("key", 1)
+	if _, ok := simple.GetRefresh("key"); ok || simple.Contains("key") {
+		t.Error("GetRefresh without fetcher should remove the key")
+	}
+}
+
+// Test Get fails fast when there are too many callers waiting for a fetch
+func TestMaxWaitersPerKey(t *testing.T) {
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		<-release
+		return key, true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 4, 10)
+	cache.SetMaxWaitersPerKey(3)
+
+	var wg sync.WaitGroup
+	var found, missed int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := cache.Get(1); ok {
+				atomic.AddInt32(&found, 1)
+			} else {
+				atomic.AddInt32(&missed, 1)
+			}
+		}()
+	}
+
+	// The extra callers don't wait for the fetch
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&missed) != 7 {
+		t.Error(fmt.Sprintf("%v Get calls failed fast expecting 7", missed))
+	}
+	close(release)
+	wg.Wait()
+	if found != 3 {
+		t.Error(fmt.Sprintf("%v Get calls found the key expecting 3", found))
+	}
+
+	// The limit is per key
+	if value, ok := cache.Get(2); !ok || value != 2 {
+		t.Error("Get failed for another key")
+	}
+	cache.Close()
+}
+
+// Test nil values returned by the fetcher are cached
+func TestFetchNilValue(t *testing.T) {
+	var fetches int32
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		atomic.AddInt32(&fetches, 1)
+		return nil, true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 2, 10)
+	for i := 0; i < 3; i++ {
+		if value, ok := cache.Get("nil"); !ok || value != nil {
+			t.Error(fmt.Sprintf("Get returned %v %v expecting nil true", value, ok))
+		}
+	}
+	if fetches != 1 {
+		t.Error(fmt.Sprintf("The nil value was fetched %v times", fetches))
+	}
+	if !cache.Contains("nil") {
+		t.Error("The nil value wasn't cached")
+	}
+	if hit, miss := cache.Stats(); hit != 2 || miss != 1 {
+		t.Error(fmt.Sprintf("Stats returned hit:%v miss:%v expecting 2 1", hit, miss))
+	}
+
+	// Values Set to nil are cached too
+	cache.Set("set", nil)
+	if value, ok := cache.Get("set"); !ok || value != nil || fetches != 1 {
+		t.Error("The nil value set wasn't cached")
+	}
+	cache.Close()
+}
+
+// Test the fetch completion callback
+func TestOnFetchComplete(t *testing.T) {
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		if key == "missing" {
+			return nil, false
+		}
+		return key, true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 2, 10)
+	completed := make(chan Result, 10)
+	cache.SetOnFetchComplete(func(key interface{}, value interface{}, ok bool) {
+		// Called without the lock, the value is already cached
+		if ok && !cache.Contains(key) {
+			t.Error("The fetched value wasn't cached before the callback")
+		}
+		completed <- Result{Value: value, OK: ok}
+	})
+
+	cache.Get("found")
+	if r := <-completed; r.Value != "found" || !r.OK {
+		t.Error(fmt.Sprintf("Unexpected completion %v", r))
+	}
+	cache.Get("missing")
+	if r := <-completed; r.Value != nil || r.OK {
+		t.Error(fmt.Sprintf("Unexpected completion %v", r))
+	}
+
+	// Cached keys aren't fetched
+	cache.Get("found")
+	select {
+	case r := <-completed:
+		t.Error(fmt.Sprintf("Unexpected completion %v", r))
+	case <-time.After(20 * time.Millisecond):
+	}
+	cache.Close()
+}
+
+// Test only fetches above the threshold are reported as slow
+func TestSlowFetch(t *testing.T) {
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		if key == "slow" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		return key, true
+	}
+
+	type slowFetch struct {
+		key interface{}
+		d   time.Duration
+	}
+	cache := NewFetchingLRUCache(100, 10, fetcher, 2, 10)
+	slow := make(chan slowFetch, 10)
+	cache.SetOnSlowFetch(func(key interface{}, d time.Duration) {
+		slow <- slowFetch{key, d}
+	})
+
+	// Disabled without threshold
+	cache.Get("slow")
+	cache.Remove("slow")
+
+	cache.SetSlowFetchThreshold(20 * time.Millisecond)
+	cache.Get("fast")
+	if value, ok := cache.Get("slow"); value != "slow" || !ok {
+		t.Error(fmt.Sprintf("Slow fetch wasn't returned %v %v", value, ok))
+	}
+	select {
+	case s := <-slow:
+		if s.key != "slow" || s.d < 30*time.Millisecond {
+			t.Error(fmt.Sprintf("Unexpected slow fetch %v", s))
+		}
+	case <-time.After(time.Second):
+		t.Error("The slow fetch wasn't reported")
+	}
+	select {
+	case s := <-slow:
+		t.Error(fmt.Sprintf("Unexpected slow fetch %v", s))
+	case <-time.After(20 * time.Millisecond):
+	}
+	cache.Close()
+}
+
+// Test CompareAndSwap doesn't match keys being fetched
+func TestCompareAndSwapFetching(t *testing.T) {
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		<-release
+		return "fetched", true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 2, 10)
+	done := make(chan interface{})
+	go func() {
+		value, _ := cache.Get(1)
+		done <- value
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if cache.CompareAndSwap(1, nil, "swapped") {
+		t.Error("CompareAndSwap matched a key being fetched")
+	}
+	close(release)
+	if value := <-done; value != "fetched" {
+		t.Error(fmt.Sprintf("Get returned %v expecting fetched", value))
+	}
+	if !cache.CompareAndSwap(1, "fetched", "swapped") {
+		t.Error("CompareAndSwap didn't match the fetched value")
+	}
+	cache.Close()
+}
+
+// Composite key used to test struct keys
+type tenantKey struct {
+	Tenant string
+	ID     int
+}
+
+// Test struct keys work through all the cache paths
+func TestStructKeys(t *testing.T) {
+	var fetches int32
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		atomic.AddInt32(&fetches, 1)
+		k := key.(tenantKey)
+		return fmt.Sprintf("%v/%v", k.Tenant, k.ID), true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 2, 10)
+
+	// Fetch, equal keys share the fetch and the cached value
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, ok := cache.Get(tenantKey{"acme", 1}); !ok || value != "acme/1" {
+				t.Error(fmt.Sprintf("Get returned %v %v", value, ok))
+			}
+		}()
+	}
+	wg.Wait()
+	if fetches != 1 {
+		t.Error(fmt.Sprintf("Equal struct keys fetched %v times", fetches))
+	}
+
+	cache.Set(tenantKey{"acme", 2}, "set")
+	if value, ok := cache.Peek(tenantKey{"acme", 2}); !ok || value != "set" {
+		t.Error("Peek failed with a struct key")
+	}
+	if cache.Contains(tenantKey{"other", 2}) {
+		t.Error("Different struct keys should be different keys")
+	}
+
+	cache.Remove(tenantKey{"acme", 1})
+	if cache.Contains(tenantKey{"acme", 1}) {
+		t.Error("Remove failed with a struct key")
+	}
+	cache.Close()
+}
+
+// Test PurgeAll discards the fetches in progress
+func TestPurgeAll(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		if key == "slow" {
+			started <- struct{}{}
+			<-release
+			return "stale", true
+		}
+		return "fresh", true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 2, 10)
+	cache.Set("cached", 1)
+
+	result := make(chan Result)
+	go func() {
+		value, ok := cache.Get("slow")
+		result <- Result{value, ok}
+	}()
+	<-started
+
+	cache.PurgeAll()
+	if r := <-result; r.OK {
+		t.Error("Get waiting for a purged fetch should return a miss")
+	}
+	if cache.Len() != 0 || cache.IsFetching("slow") {
+		t.Error("PurgeAll didn't clear the cache")
+	}
+
+	// The purged fetch result is discarded when it finishes
+	close(release)
+	for cache.Metrics().Fetches < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if cache.Contains("slow") {
+		t.Error("The purged fetch value was cached")
+	}
+
+	// New fetches work normally
+	if value, _ := cache.Get("key"); value != "fresh" {
+		t.Error(fmt.Sprintf("Get returned %v after PurgeAll", value))
+	}
+	cache.Close()
+}
+
+// Test IsFetching reports the fetches in progress
+func TestIsFetching(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		close(started)
+		<-release
+		return key, true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 2, 10)
+	if cache.IsFetching(1) {
+		t.Error("IsFetching should be false before Get")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cache.Get(1)
+		close(done)
+	}()
+	<-started
+	if !cache.IsFetching(1) || cache.IsFetching(2) {
+		t.Error("IsFetching didn't report the fetch in progress")
+	}
+	if keys := cache.InflightKeys(); len(keys) != 1 || keys[0] != 1 {
+		t.Errorf("InflightKeys returned %v expecting [1]", keys)
+	}
+
+	close(release)
+	<-done
+	if cache.IsFetching(1) {
+		t.Error("IsFetching should be false after the fetch")
+	}
+	if keys := cache.InflightKeys(); len(keys) != 0 {
+		t.Errorf("InflightKeys returned %v after the fetch", keys)
+	}
+	cache.Close()
+}
+
+// Test the constructors returning errors
+func TestNewLRUCacheE(t *testing.T) {
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		return key, true
+	}
+
+	if _, err := NewLRUCacheE(0, 1); err == nil {
+		t.Error("NewLRUCacheE should fail with size 0")
+	}
+	if _, err := NewLRUCacheE(10, 0); err == nil {
+		t.Error("NewLRUCacheE should fail with prune size 0")
+	}
+	if _, err := NewFetchingLRUCacheE(10, 1, fetcher, 0, 10); err == nil {
+		t.Error("NewFetchingLRUCacheE should fail without workers")
+	}
+	if _, err := NewFetchingLRUCacheE(10, 1, fetcher, 1, 0); err == nil {
+		t.Error("NewFetchingLRUCacheE should fail without queue")
+	}
+
+	cache, err := NewFetchingLRUCacheE(10, 1, fetcher, 1, 1)
+	if err != nil || cache == nil {
+		t.Error("NewFetchingLRUCacheE failed with valid arguments")
+		return
+	}
+	if value, _ := cache.Get(1); value != 1 {
+		t.Error("The cache doesn't work")
+	}
+	cache.Close()
+
+	if cache, err := NewLRUCacheE(10, 1); err != nil || cache == nil {
+		t.Error("NewLRUCacheE failed with valid arguments")
+	}
+}
+
+// Test GetWithFill calls onFill once per fill, only from the Get that
+// started the fetch
+func TestGetWithFill(t *testing.T) {
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		return key, key != 2
+	}
+
+	before := newSeam()
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 10,
+		withWorkerHooks(workerHooks{beforeFetch: before.hook}))
+
+	var fills int32
+	onFill := func(key, value interface{}) {
+		if key != 1 || value != 1 {
+			t.Error(fmt.Sprintf("onFill called with %v, %v", key, value))
+		}
+		atomic.AddInt32(&fills, 1)
+	}
+
+	// Coalesced Gets, only the first one fills the cache
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, ok := cache.GetWithFill(1, onFill); !ok || value != 1 {
+				t.Error(fmt.Sprintf("GetWithFill returned %v %v", value, ok))
+			}
+		}()
+	}
+	<-before.reached
+	for _, miss := cache.Stats(); miss < 5; _, miss = cache.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+	close(before.release)
+	wg.Wait()
+	go func() {
+		for range before.reached {
+		}
+	}()
+
+	if fills != 1 {
+		t.Error(fmt.Sprintf("onFill called %v times expecting 1", fills))
+	}
+
+	// Cache hits and failed fetches don't fill
+	cache.GetWithFill(1, onFill)
+	cache.GetWithFill(2, onFill)
+	if fills != 1 {
+		t.Error(fmt.Sprintf("onFill called %v times expecting 1", fills))
+	}
+	cache.Close()
+}
+
+// Test GetWithFill with a miss handler
+func TestGetWithFillMissHandler(t *testing.T) {
+	cache := NewLRUCache(100, 10)
+	cache.SetMissHandler(func(key interface{}) (value interface{}, ok bool) {
+		return key, true
+	})
+
+	fills := 0
+	onFill := func(key, value interface{}) {
+		fills++
+	}
+	if value, ok := cache.GetWithFill(1, onFill); !ok || value != 1 {
+		t.Error(fmt.Sprintf("GetWithFill returned %v %v", value, ok))
+	}
+	cache.GetWithFill(1, onFill)
+	if fills != 1 {
+		t.Error(fmt.Sprintf("onFill called %v times expecting 1", fills))
+	}
+
+	// No fill without fetch function or miss handler
+	cache = NewLRUCache(100, 10)
+	if _, ok := cache.GetWithFill(1, onFill); ok || fills != 1 {
+		t.Error("GetWithFill filled a cache without miss handler")
+	}
+}
+
+// Test oversized fetched values are returned but not cached
+func TestFetchMaxValueSize(t *testing.T) {
+	var fetches int32
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		atomic.AddInt32(&fetches, 1)
+		return make([]byte, key.(int)), true
+	}
+
+	cache := NewFetchingLRUCache(10, 1, fetcher, 1, 10)
+	cache.SetMaxValueSize(4)
+	for i := 0; i < 2; i++ {
+		if value, ok := cache.Get(5); !ok || len(value.([]byte)) != 5 {
+			t.Error("Oversized fetched value wasn't returned")
+		}
+	}
+	if _, ok := cache.Peek(5); ok {
+		t.Error("Oversized fetched value was cached")
+	}
+	if fetches != 2 {
+		t.Error(fmt.Sprintf("Expected 2 fetches for the oversized key, got %v", fetches))
+	}
+
+	cache.Get(4)
+	if _, ok := cache.Peek(4); !ok {
+		t.Error("Fetched value with the max size wasn't cached")
+	}
+	cache.Close()
+}
+
+// Test GetE fetches missing keys, returning ErrNotFound when the fetch fails
+func TestFetchGetE(t *testing.T) {
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		return key, key != 2
+	}
+
+	cache := NewFetchingLRUCache(10, 1, fetcher, 1, 10)
+	if value, err := cache.GetE(1); err != nil || value != 1 {
+		t.Error(fmt.Sprintf("GetE returned %v %v", value, err))
+	}
+	if _, err := cache.GetE(2); err != ErrNotFound {
+		t.Error(fmt.Sprintf("GetE returned %v for a failed fetch", err))
+	}
+	cache.Close()
+
+	// After Close misses are ErrClosed, and Get is still a plain miss
+	if _, err := cache.GetE(3); err != ErrClosed {
+		t.Error(fmt.Sprintf("GetE returned %v after Close", err))
+	}
+	if value, ok := cache.Get(3); ok || value != nil {
+		t.Error("Get didn't return a miss after Close")
+	}
+	if value, err := cache.GetE(1); err != nil || value != 1 {
+		t.Error("GetE didn't return a cached value after Close")
+	}
+}
+
+// Test WaitIdle blocks until the fetches queued and in progress finish
+func TestWaitIdle(t *testing.T) {
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		return key, true
+	}
+
+	before := newSeam()
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 10,
+		withWorkerHooks(workerHooks{beforeFetch: before.hook}))
+
+	// Idle cache returns immediately
+	cache.WaitIdle()
+
+	for i := 0; i < 3; i++ {
+		go cache.Get(i)
+	}
+	<-before.reached
+	for cache.Metrics().Enqueued < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	idle := make(chan struct{})
+	go func() {
+		cache.WaitIdle()
+		close(idle)
+	}()
+	go func() {
+		cache.WaitIdle() // Concurrent waits share the wakeup
+	}()
+
+	// Release the fetches one by one
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			<-before.reached
+		}
+		select {
+		case <-idle:
+			t.Error("WaitIdle returned with fetches pending")
+		default:
+		}
+		before.release <- struct{}{}
+	}
+
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Error("WaitIdle didn't return after the fetches finished")
+	}
+	if cache.Len() != 3 {
+		t.Error("WaitIdle returned before the values were cached")
+	}
+	cache.Close()
+}
+
+// Test the gets beyond the max concurrent gets fail fast
+func TestMaxConcurrentGets(t *testing.T) {
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		return key, true
+	}
+
+	before := newSeam()
+	cache := NewFetchingLRUCache(10, 1, fetcher, 1, 10,
+		withWorkerHooks(workerHooks{beforeFetch: before.hook}))
+	cache.SetMaxConcurrentGets(2)
+	cache.Set("cached", 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, ok := cache.Get(1); !ok || value != 1 {
+				t.Error("Get within the limit failed")
+			}
+		}()
+	}
+	<-before.reached
+	for _, miss := cache.Stats(); miss < 2; _, miss = cache.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Both slots are taken by the Gets waiting for the fetch
+	if _, ok := cache.Get("cached"); ok {
+		t.Error("Get beyond the limit didn't fail")
+	}
+	if _, ok := cache.GetWithPriority(2, 1); ok {
+		t.Error("GetWithPriority beyond the limit didn't fail")
+	}
+	if _, err := cache.GetE("cached"); err != ErrBusy {
+		t.Error(fmt.Sprintf("GetE returned %v expecting ErrBusy", err))
+	}
+	if _, miss := cache.Stats(); miss != 2 {
+		t.Error("Rejected gets looked up the key")
+	}
+
+	close(before.release)
+	wg.Wait()
+
+	// The slots are released
+	if _, err := cache.GetE("cached"); err != nil {
+		t.Error(fmt.Sprintf("GetE failed after the gets returned %v", err))
+	}
+
+	// Zero removes the limit
+	cache.SetMaxConcurrentGets(0)
+	if _, ok := cache.Get(1); !ok {
+		t.Error("Get failed without limit")
+	}
+	cache.Close()
+}
+
+// Test GetOrDefault fetches missing keys
+func TestFetchingGetOrDefault(t *testing.T) {
+	storage := newStorage(10)
+
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		return storage.Get(key)
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 10)
+	if value := cache.GetOrDefault(5, -1); value != 5 {
+		t.Error("GetOrDefault didn't fetch the missing key")
+	}
+	if value := cache.GetOrDefault(50, -1); value != -1 {
+		t.Error("GetOrDefault didn't return the default after a failed fetch")
+	}
+
+	cache.Close()
+}
+
+// Test Shutdown waits for the fetches in progress
+func TestShutdown(t *testing.T) {
+	storage := newStorage(1000)
+
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		<-release
+		return storage.Get(key)
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 10)
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = cache.Get(i)
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- cache.Shutdown(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// No new fetches are accepted while shutting down
+	if _, ok := cache.Get(5); ok {
+		t.Error("Get fetched a key while shutting down")
+	}
+
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Error("Unexpected Shutdown error: ", err)
+	}
+	wg.Wait()
+	if results[0] != 0 || results[1] != 1 {
+		t.Error("Shutdown didn't wait for the pending fetches")
+	}
+
+	// Shutdown after close does nothing
+	if err := cache.Shutdown(context.Background()); err != nil {
+		t.Error("Unexpected error on second Shutdown: ", err)
+	}
+}
+
+// Test Shutdown returns when the context expires
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		<-release
+		return key, true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 1, 10)
+
+	var wg sync.WaitGroup
+	var result interface{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		cache.Get(1) // Blocks the worker
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		defer wg.Done()
+		result, _ = cache.Get(2) // Queued
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := cache.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("Shutdown should have returned DeadlineExceeded not ", err)
+	}
+
+	close(release)
+	wg.Wait()
+	if result != nil {
+		t.Error("Queued fetch should have failed after Shutdown timeout")
+	}
+}
+
+// Test fetching with a preallocated fetch map
+func TestFetchMapHint(t *testing.T) {
+	storage := newStorage(1000)
+
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		return storage.Get(key)
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 4, 100, WithFetchMapHint(100))
+	results := cache.GetOrdered([]interface{}{1, 2, 3})
+	for i, result := range results {
+		if !result.OK || result.Value != i+1 {
+			t.Error("Fetch failed with a preallocated fetch map")
+		}
+	}
+
+	cache.Close()
+}
+
+// Test fetches for keys with the same coalesce key are shared
+func TestCoalesceKey(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var fetched []interface{}
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		<-release
+		lock.Lock()
+		fetched = append(fetched, key)
+		lock.Unlock()
+		return "value of " + strings.TrimSuffix(key.(string), "/"), true
+	}
+
+	trimSlash := func(key interface{}) interface{} {
+		return strings.TrimSuffix(key.(string), "/")
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 2, 10, WithCoalesceKey(trimSlash))
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 3)
+	for i, key := range []string{"/a", "/a/", "/a"} {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			results[i], _ = cache.Get(key)
+		}(i, key)
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if len(fetched) != 1 || fetched[0] != "/a" {
+		t.Error(fmt.Sprintf("Expected a single fetch for /a, fetched %v", fetched))
+	}
+	for _, result := range results {
+		if result != "value of /a" {
+			t.Error(fmt.Sprintf("Unexpected Get result %v", result))
+		}
+	}
+
+	// The value is cached under both keys
+	if !cache.Contains("/a") || !cache.Contains("/a/") || cache.Len() != 2 {
+		t.Error("Fetched value wasn't cached under all the requested keys")
+	}
+
+	cache.Close()
+}
+
+// Test fetch latency metrics
+func TestFetchLatency(t *testing.T) {
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		time.Sleep(time.Duration(key.(int)) * time.Millisecond)
+		return key, true
+	}
+
+	cache := NewFetchingLRUCache(100, 10, fetcher, 2, 10)
+	if cache.AvgFetchLatency() != 0 {
+		t.Error("Average latency should be 0 before any fetch")
+	}
+
+	cache.GetOrdered([]interface{}{10, 30})
+	cache.Get(10) // Cached, not measured
+
+	m := cache.Metrics()
+	if m.Fetches != 2 || m.Hits != 1 || m.Misses != 2 {
+		t.Error(fmt.Sprintf("Unexpected metrics %+v", m))
+	}
+	if m.FetchTime < 40*time.Millisecond {
+		t.Error(fmt.Sprintf("Fetch time %v is too low", m.FetchTime))
+	}
+	if avg := cache.AvgFetchLatency(); avg < 20*time.Millisecond || avg > m.FetchTime {
+		t.Error(fmt.Sprintf("Unexpected average fetch latency %v", avg))
+	}
+
+	cache.Close()
 }
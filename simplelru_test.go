@@ -1,8 +1,12 @@
 package simplelru
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -405,6 +409,1614 @@ func TestRemoveNewest(t *testing.T) {
 	}
 }
 
+// Test PopOldest and PopNewest return the removed items
+func TestPopOldestNewest(t *testing.T) {
+	cache := NewLRUCache(100, 10)
+
+	// Popping from an empty cache should work
+	if key, value, ok := cache.PopOldest(); key != nil || value != nil || ok {
+		t.Error("PopOldest returned an item from an empty cache")
+	}
+	if key, value, ok := cache.PopNewest(); key != nil || value != nil || ok {
+		t.Error("PopNewest returned an item from an empty cache")
+	}
+
+	for i := 0; i < 10; i++ {
+		cache.Set(i, i*10)
+	}
+
+	if key, value, ok := cache.PopOldest(); key != 0 || value != 0 || !ok {
+		t.Error(fmt.Sprintf("PopOldest expected 0, 0, true -> %v %v %v", key, value, ok))
+	}
+	if key, value, ok := cache.PopNewest(); key != 9 || value != 90 || !ok {
+		t.Error(fmt.Sprintf("PopNewest expected 9, 90, true -> %v %v %v", key, value, ok))
+	}
+
+	if cache.Len() != 8 || cache.Contains(0) || cache.Contains(9) {
+		t.Error("Popped items weren't removed from cache")
+	}
+}
+
+// Test a frozen cache ignores all mutations
+func TestFreeze(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	for i := 0; i < 10; i++ {
+		cache.Set(i, i)
+	}
+
+	cache.Freeze()
+	if !cache.Frozen() {
+		t.Error("Frozen should be true after Freeze")
+	}
+
+	if pruned := cache.Set(100, 100); pruned || cache.Contains(100) {
+		t.Error("Set modified a frozen cache")
+	}
+	cache.Set(0, 1000)
+	cache.Remove(1)
+	cache.RemoveOldest()
+	cache.RemoveNewest()
+	if _, _, ok := cache.PopOldest(); ok {
+		t.Error("PopOldest modified a frozen cache")
+	}
+	cache.Purge()
+	cache.Resize(5, 1)
+
+	if cache.Len() != 10 {
+		t.Error("A frozen cache was modified")
+	}
+
+	// Reads still work but don't refresh the keys
+	if value, ok := cache.Get(0); !ok || value != 0 {
+		t.Error("Get failed on a frozen cache")
+	}
+	if hit, _ := cache.Stats(); hit != 1 {
+		t.Error("Get on a frozen cache didn't update stats")
+	}
+
+	cache.Unfreeze()
+	if cache.Frozen() {
+		t.Error("Frozen should be false after Unfreeze")
+	}
+
+	// 0 wasn't refreshed so it is the first one pruned
+	cache.Set(100, 100)
+	if cache.Contains(0) || !cache.Contains(100) {
+		t.Error("Unfreeze didn't restore normal operation")
+	}
+}
+
+// Test keys sent to InvalidateChan are removed
+func TestInvalidateChan(t *testing.T) {
+	cache := NewLRUCache(100, 10)
+	for i := 0; i < 10; i++ {
+		cache.Set(i, i)
+	}
+
+	invalidate := cache.InvalidateChan()
+	if invalidate != cache.InvalidateChan() {
+		t.Error("InvalidateChan should always return the same channel")
+	}
+
+	invalidate <- 1
+	invalidate <- 2
+
+	// Wait until the invalidations are processed
+	for i := 0; i < 100 && cache.Len() != 8; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cache.Contains(1) || cache.Contains(2) || cache.Len() != 8 {
+		t.Error("The invalidated keys weren't removed")
+	}
+
+	// Queued invalidations are applied before Close returns
+	for i := 3; i < 10; i++ {
+		invalidate <- i
+	}
+	cache.Close()
+	if cache.Len() != 1 || !cache.Contains(0) {
+		t.Error("Close didn't drain the invalidation queue")
+	}
+}
+
+// Test Do coalesces concurrent calls without caching the results
+func TestDo(t *testing.T) {
+	cache := NewLRUCache(100, 10)
+
+	// Single call
+	value, err, shared := cache.Do(1, func() (interface{}, error) {
+		return "one", nil
+	})
+	if value != "one" || err != nil || shared {
+		t.Error(fmt.Sprintf("Unexpected Do result %v %v %v", value, err, shared))
+	}
+	if cache.Contains(1) {
+		t.Error("Do result shouldn't be cached")
+	}
+
+	// Errors are returned to the caller
+	failure := errors.New("failure")
+	if _, err, _ := cache.Do(1, func() (interface{}, error) { return nil, failure }); err != failure {
+		t.Error("Do didn't return the call error")
+	}
+
+	// Concurrent calls share one execution
+	release := make(chan struct{})
+	var lock sync.Mutex
+	calls := 0
+	fn := func() (interface{}, error) {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		<-release
+		return "shared", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]bool, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, _, shared := cache.Do(2, fn)
+			results[i] = value == "shared" && shared
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Error(fmt.Sprintf("Concurrent Do calls executed fn %v times", calls))
+	}
+	for _, ok := range results {
+		if !ok {
+			t.Error("Concurrent Do calls didn't share the result")
+		}
+	}
+
+	cache.Close()
+}
+
+// Test a panic in fn doesn't leave the key blocked
+func TestDoPanic(t *testing.T) {
+	cache := NewLRUCache(100, 10)
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		cache.Do(1, func() (interface{}, error) {
+			close(started)
+			<-release
+			panic("call failed")
+		})
+	}()
+	<-started
+
+	// Callers waiting for the call receive an error
+	waiter := make(chan error)
+	go func() {
+		_, err, _ := cache.Do(1, func() (interface{}, error) { return "unexpected", nil })
+		waiter <- err
+	}()
+	for {
+		cache.Lock()
+		dups := cache.callM[1].dups
+		cache.Unlock()
+		if dups > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	if r := <-panicked; r != "call failed" {
+		t.Error(fmt.Sprintf("The panic wasn't propagated %v", r))
+	}
+	if err := <-waiter; err != ErrPanicked {
+		t.Error(fmt.Sprintf("Waiting caller returned %v expecting ErrPanicked", err))
+	}
+
+	// Later calls execute fn again
+	value, err, shared := cache.Do(1, func() (interface{}, error) { return "one", nil })
+	if value != "one" || err != nil || shared {
+		t.Error(fmt.Sprintf("Unexpected Do result after a panic %v %v %v", value, err, shared))
+	}
+	cache.Close()
+}
+
+// Test MemoryUsage estimate with and without weigher
+func TestMemoryUsage(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	cache.Set(1, "value")
+	cache.Set(2, "value")
+	if usage := cache.MemoryUsage(); usage != 2*entryOverhead {
+		t.Error(fmt.Sprintf("Unexpected memory usage %v", usage))
+	}
+
+	weigher := func(value interface{}) int64 {
+		return int64(len(value.(string)))
+	}
+	cache = NewLRUCache(2, 1, WithWeigher(weigher))
+	cache.Set(1, "one")
+	cache.Set(2, "two")
+	cache.Set(2, "second") // Update
+	if usage := cache.MemoryUsage(); usage != 2*entryOverhead+9 {
+		t.Error(fmt.Sprintf("Unexpected memory usage %v", usage))
+	}
+
+	cache.Set(3, "three") // Prunes 1
+	if usage := cache.MemoryUsage(); usage != 2*entryOverhead+11 {
+		t.Error(fmt.Sprintf("Unexpected memory usage after prune %v", usage))
+	}
+
+	cache.Remove(2)
+	if usage := cache.MemoryUsage(); usage != entryOverhead+5 {
+		t.Error(fmt.Sprintf("Unexpected memory usage after Remove %v", usage))
+	}
+
+	cache.Purge()
+	if usage := cache.MemoryUsage(); usage != 0 {
+		t.Error(fmt.Sprintf("Unexpected memory usage after Purge %v", usage))
+	}
+}
+
+// Test Put writes to the backing store before updating the cache
+func TestPut(t *testing.T) {
+	store := make(map[interface{}]interface{})
+	failure := errors.New("write failure")
+	writer := func(key interface{}, value interface{}) error {
+		if key == "readonly" {
+			return failure
+		}
+		store[key] = value
+		return nil
+	}
+
+	cache := NewLRUCache(100, 10, WithWriter(writer))
+
+	if err := cache.Put(1, "one"); err != nil {
+		t.Error("Unexpected Put error: ", err)
+	}
+	if value, ok := cache.Peek(1); !ok || value != "one" || store[1] != "one" {
+		t.Error("Put didn't write the value to the cache and store")
+	}
+
+	if err := cache.Put("readonly", 2); err != failure {
+		t.Error("Put didn't return the writer error")
+	}
+	if cache.Contains("readonly") {
+		t.Error("Put updated the cache after a write error")
+	}
+
+	// Frozen caches don't write
+	cache.Freeze()
+	if err := cache.Put(1, "new"); err != ErrFrozen {
+		t.Error(fmt.Sprintf("Put on a frozen cache returned %v expecting ErrFrozen", err))
+	}
+	cache.Unfreeze()
+	if value, _ := cache.Peek(1); value != "one" || store[1] != "one" {
+		t.Error("Put on a frozen cache modified the cache or store")
+	}
+
+	// Without writer Put is a Set
+	cache = NewLRUCache(100, 10)
+	if err := cache.Put(1, 1); err != nil || !cache.Contains(1) {
+		t.Error("Put without writer failed")
+	}
+}
+
+// Test Oldest and Newest don't modify the cache
+func TestOldestNewest(t *testing.T) {
+	cache := NewLRUCache(100, 10)
+	if _, _, ok := cache.Oldest(); ok {
+		t.Error("Oldest returned an item from an empty cache")
+	}
+	if _, _, ok := cache.Newest(); ok {
+		t.Error("Newest returned an item from an empty cache")
+	}
+
+	for i := 0; i < 10; i++ {
+		cache.Set(i, i*10)
+	}
+	cache.Get(0)
+
+	if key, value, ok := cache.Oldest(); key != 1 || value != 10 || !ok {
+		t.Error(fmt.Sprintf("Oldest expected 1, 10, true -> %v %v %v", key, value, ok))
+	}
+	if key, value, ok := cache.Newest(); key != 0 || value != 0 || !ok {
+		t.Error(fmt.Sprintf("Newest expected 0, 0, true -> %v %v %v", key, value, ok))
+	}
+
+	if hit, miss := cache.Stats(); cache.Len() != 10 || hit != 1 || miss != 0 {
+		t.Error("Oldest or Newest modified the cache")
+	}
+}
+
+// Test GetOrDefault returns the default value on misses
+func TestGetOrDefault(t *testing.T) {
+	cache := NewLRUCache(100, 10)
+	cache.Set(1, "one")
+
+	if value := cache.GetOrDefault(1, "default"); value != "one" {
+		t.Error("GetOrDefault didn't return the cached value")
+	}
+	if value := cache.GetOrDefault(2, "default"); value != "default" {
+		t.Error("GetOrDefault didn't return the default value")
+	}
+	if hit, miss := cache.Stats(); hit != 1 || miss != 1 {
+		t.Error("GetOrDefault didn't update stats")
+	}
+}
+
+// Test pinned keys are never pruned
+func TestPin(t *testing.T) {
+	cache := NewLRUCache(5, 2)
+	for i := 0; i < 5; i++ {
+		cache.Set(i, i)
+	}
+
+	if !cache.Pin(0) || !cache.Pin(1) {
+		t.Error("Pin failed for cached keys")
+	}
+	if cache.Pin(100) {
+		t.Error("Pin succeeded for a missing key")
+	}
+
+	// 0 and 1 are skipped, 2 and 3 pruned
+	cache.Set(5, 5)
+	if !cache.Contains(0) || !cache.Contains(1) || cache.Contains(2) ||
+		cache.Contains(3) || cache.Len() != 4 {
+		t.Error("Prune didn't skip the pinned keys")
+	}
+
+	if key, _, ok := cache.PopOldest(); !ok || key != 4 {
+		t.Error(fmt.Sprintf("PopOldest returned %v expected 4", key))
+	}
+
+	// With all keys pinned new keys are rejected
+	cache.Set(6, 6)
+	cache.Set(8, 8)
+	cache.Pin(5)
+	cache.Pin(6)
+	cache.Pin(8)
+	cache.Set(7, 7)
+	if cache.Contains(7) || cache.Len() != 5 {
+		t.Error("Set should have been rejected with all keys pinned")
+	}
+	cache.RemoveOldest()
+	if cache.Len() != 5 {
+		t.Error("RemoveOldest removed a pinned key")
+	}
+
+	// Unpinned keys can be pruned again
+	if !cache.Unpin(0) || cache.Unpin(0) {
+		t.Error("Unpin returned an unexpected result")
+	}
+	cache.Set(7, 7)
+	if cache.Contains(0) || !cache.Contains(7) {
+		t.Error("Unpinned key wasn't pruned")
+	}
+
+	// Removed keys lose their pin
+	cache.Remove(1)
+	if cache.Unpin(1) {
+		t.Error("Removed key is still pinned")
+	}
+}
+
+// Test OnFull is called only when the cache first becomes full
+func TestOnFull(t *testing.T) {
+	cache := NewLRUCache(10, 2)
+	calls := 0
+	cache.SetOnFull(func() { calls++ })
+
+	for i := 0; i < 10; i++ {
+		cache.Set(i, i)
+	}
+	if calls != 0 {
+		t.Error("OnFull called before the cache was pruned")
+	}
+
+	// Only the first prune calls it
+	for i := 10; i < 20; i++ {
+		cache.Set(i, i)
+	}
+	if calls != 1 {
+		t.Error(fmt.Sprintf("OnFull called %v times, expected 1", calls))
+	}
+
+	// Removing an entry resets the edge
+	cache.Remove(19)
+	cache.Set(19, 19)
+	cache.Set(20, 20)
+	if calls != 2 {
+		t.Error(fmt.Sprintf("OnFull called %v times, expected 2", calls))
+	}
+
+	cache.Purge()
+	for i := 0; i < 11; i++ {
+		cache.Set(i, i)
+	}
+	if calls != 3 {
+		t.Error(fmt.Sprintf("OnFull called %v times after Purge, expected 3", calls))
+	}
+}
+
+// Test AgeHistogram counts keys by insertion age
+func TestLastAccess(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	cache.Set(1, 1)
+	if _, ok := cache.LastAccess(1); ok {
+		t.Error("LastAccess should fail without access tracking")
+	}
+
+	cache = NewLRUCache(10, 1, WithAccessTracking())
+	start := time.Now()
+	cache.Set(1, 1)
+	set, ok := cache.LastAccess(1)
+	if !ok || set.Before(start) {
+		t.Error("Set didn't record the access time")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	cache.Peek(1)
+	cache.GetNoPromote(1)
+	if accessed, _ := cache.LastAccess(1); !accessed.Equal(set) {
+		t.Error("Peek or GetNoPromote changed the access time")
+	}
+	cache.Get(1)
+	if accessed, _ := cache.LastAccess(1); !accessed.After(set) {
+		t.Error("Get didn't update the access time")
+	}
+
+	if _, ok := cache.LastAccess(2); ok {
+		t.Error("LastAccess returned a time for a missing key")
+	}
+	cache.Remove(1)
+	if _, ok := cache.LastAccess(1); ok {
+		t.Error("Removed key access time wasn't deleted")
+	}
+	cache.Set(2, 2)
+	cache.Purge()
+	if _, ok := cache.LastAccess(2); ok {
+		t.Error("Purge didn't clear the access times")
+	}
+}
+
+func TestAgeHistogram(t *testing.T) {
+	if NewLRUCache(10, 1).AgeHistogram(nil) != nil {
+		t.Error("AgeHistogram should return nil without age tracking")
+	}
+
+	cache := NewLRUCache(10, 1, WithAgeTracking())
+	cache.Set(1, 1)
+	cache.Set(2, 2)
+	time.Sleep(50 * time.Millisecond)
+	cache.Set(3, 3)
+	cache.Set(1, 10) // Updates don't change the insertion time
+
+	buckets := []time.Duration{20 * time.Millisecond, time.Hour}
+	histogram := cache.AgeHistogram(buckets)
+	if fmt.Sprint(histogram) != "[1 2 0]" {
+		t.Error(fmt.Sprintf("Unexpected age histogram %v", histogram))
+	}
+
+	cache.Remove(2)
+	if histogram := cache.AgeHistogram(buckets); fmt.Sprint(histogram) != "[1 1 0]" {
+		t.Error(fmt.Sprintf("Unexpected age histogram after Remove %v", histogram))
+	}
+
+	cache.Purge()
+	if histogram := cache.AgeHistogram(nil); fmt.Sprint(histogram) != "[0]" {
+		t.Error(fmt.Sprintf("Unexpected age histogram after Purge %v", histogram))
+	}
+
+	// SetMinResidency enables tracking for the keys cached afterwards
+	cache = NewLRUCache(10, 1)
+	cache.Set(1, 1)
+	cache.SetMinResidency(time.Hour)
+	cache.Set(2, 2)
+	if histogram := cache.AgeHistogram(nil); fmt.Sprint(histogram) != "[1]" {
+		t.Error(fmt.Sprintf("Unexpected age histogram with min residency %v", histogram))
+	}
+}
+
+// Test Equal compares contents and order
+func TestEqual(t *testing.T) {
+	a := NewLRUCache(10, 1)
+	b := NewLRUCache(100, 10)
+	if !a.Equal(b) || !a.Equal(a) {
+		t.Error("Empty caches should be equal")
+	}
+
+	for i := 0; i < 5; i++ {
+		a.Set(i, []int{i})
+		b.Set(i, []int{i})
+	}
+	b.Get(1) // Stats are ignored
+	a.Get(1)
+	if !a.Equal(b) || !b.Equal(a) {
+		t.Error("Caches with the same contents should be equal")
+	}
+
+	// Different order
+	a.Get(2)
+	if a.Equal(b) {
+		t.Error("Caches with different order shouldn't be equal")
+	}
+	b.Get(2)
+
+	// Different value
+	b.Set(2, []int{20})
+	if a.Equal(b) {
+		t.Error("Caches with different values shouldn't be equal")
+	}
+
+	// Different length
+	b.Set(2, []int{2})
+	b.Set(5, []int{5})
+	if a.Equal(b) {
+		t.Error("Caches with different length shouldn't be equal")
+	}
+
+	// Concurrent comparisons in both directions don't deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); a.Equal(b) }()
+		go func() { defer wg.Done(); b.Equal(a) }()
+	}
+	wg.Wait()
+}
+
+// Test GetNoPromote doesn't refresh keys
+func TestGetNoPromote(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	for i := 0; i < 10; i++ {
+		cache.Set(i, i)
+	}
+
+	if value, ok := cache.GetNoPromote(0); !ok || value != 0 {
+		t.Error("GetNoPromote returned an unexpected value")
+	}
+	if _, ok := cache.GetNoPromote(100); ok {
+		t.Error("GetNoPromote returned a missing key")
+	}
+	if hit, miss := cache.Stats(); hit != 1 || miss != 1 {
+		t.Error("GetNoPromote didn't update the stats")
+	}
+
+	// 0 wasn't refreshed so it is pruned first
+	cache.Set(10, 10)
+	if cache.Contains(0) {
+		t.Error("GetNoPromote refreshed the key")
+	}
+}
+
+func TestByteCache(t *testing.T) {
+	cache := NewByteCache(10)
+
+	cache.Set(1, make([]byte, 4))
+	cache.Set(2, make([]byte, 4))
+	if cache.Bytes() != 8 {
+		t.Errorf("Bytes() returned %v expecting 8", cache.Bytes())
+		return
+	}
+
+	// Evict the oldest until there is room for the new value
+	cache.Set(3, make([]byte, 4))
+	if cache.Bytes() != 8 || cache.Contains(1) {
+		t.Error("The oldest entry wasn't evicted")
+		return
+	}
+
+	// Updating an entry only accounts the difference
+	cache.Set(3, make([]byte, 6))
+	if cache.Bytes() != 10 || cache.Len() != 2 {
+		t.Errorf("Bytes() returned %v after update", cache.Bytes())
+		return
+	}
+
+	// Values bigger than the limit are not cached, and don't evict entries
+	var evicted []interface{}
+	cache.SetOnEvict(func(key interface{}, value interface{}) {
+		evicted = append(evicted, key)
+	})
+	if cache.Set(4, make([]byte, 11)) {
+		t.Error("Set returned true for a value bigger than the cache limit")
+	}
+	if cache.Contains(4) {
+		t.Error("Value bigger than the cache limit was cached")
+	}
+	if cache.Len() != 2 || cache.Bytes() != 10 || len(evicted) != 0 {
+		t.Errorf("Value bigger than the cache limit evicted %v", evicted)
+	}
+	cache.SetOnEvict(nil)
+
+	// Not limited by the number of entries
+	cache.Purge()
+	for i := 0; i < 1000; i++ {
+		cache.Set(i, []byte{})
+	}
+	if cache.Len() != 1000 || cache.Bytes() != 0 {
+		t.Errorf("Cache has %v entries expecting 1000", cache.Len())
+	}
+}
+
+func TestEvictionRate(t *testing.T) {
+	cache := NewLRUCache(10, 2)
+	if cache.EvictionRate() != 0 {
+		t.Error("Empty cache eviction rate should be 0")
+	}
+
+	for i := 0; i < 10; i++ {
+		cache.Set(i, i)
+	}
+	cache.Remove(0)
+	if cache.EvictionRate() != 0 {
+		t.Error("Removals aren't evictions")
+	}
+
+	// Each prune evicts 2 entries
+	for i := 10; i < 21; i++ {
+		cache.Set(i, i)
+	}
+	if rate := cache.EvictionRate(); rate != 10.0/evictionWindow {
+		t.Errorf("EvictionRate returned %v expecting %v", rate, 10.0/evictionWindow)
+	}
+}
+
+func TestSetIfChanged(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	cache.Set(1, "one")
+	cache.Set(2, "two")
+
+	if cache.SetIfChanged(1, "one", nil) {
+		t.Error("SetIfChanged updated an unchanged value")
+	}
+	if key, _, _ := cache.Newest(); key != 2 {
+		t.Error("SetIfChanged refreshed an unchanged value")
+	}
+
+	if !cache.SetIfChanged(1, "uno", nil) {
+		t.Error("SetIfChanged didn't update a changed value")
+	}
+	if key, value, _ := cache.Newest(); key != 1 || value != "uno" {
+		t.Error("SetIfChanged didn't refresh the changed value")
+	}
+
+	if !cache.SetIfChanged(3, "three", nil) || !cache.Contains(3) {
+		t.Error("SetIfChanged didn't set a new key")
+	}
+
+	// Custom equality
+	caseless := func(a, b interface{}) bool {
+		return strings.EqualFold(a.(string), b.(string))
+	}
+	if cache.SetIfChanged(3, "THREE", caseless) {
+		t.Error("SetIfChanged ignored the equality function")
+	}
+
+	// Uncomparable values
+	cache.Set(4, []int{1})
+	if !cache.SetIfChanged(4, []int{1}, nil) {
+		t.Error("Uncomparable values should be always different")
+	}
+}
+
+func TestSwapContents(t *testing.T) {
+	cache := NewLRUCache(3, 1)
+	cache.Set(1, 1)
+	cache.Set(2, 2)
+	cache.Pin(1)
+
+	cache.SwapContents([]Entry{{"a", 1}, {"b", 2}, {"a", 3}})
+	if cache.Contains(1) || cache.Contains(2) || cache.Len() != 2 {
+		t.Error("SwapContents didn't replace the old contents")
+	}
+	if key, value, _ := cache.Newest(); key != "a" || value != 3 {
+		t.Error("SwapContents didn't keep the last value of repeated keys")
+	}
+
+	// Only the last entries that fit are kept
+	cache.SwapContents([]Entry{{1, 1}, {2, 2}, {3, 3}, {4, 4}})
+	if cache.Contains(1) || cache.Len() != 3 {
+		t.Error("SwapContents didn't truncate the entries")
+	}
+	if key, _, _ := cache.Oldest(); key != 2 {
+		t.Error("SwapContents didn't keep the entries order")
+	}
+
+	// Size and prune size are preserved
+	cache.Set(5, 5)
+	if cache.Len() != 3 || cache.Contains(2) {
+		t.Error("The cache size changed after SwapContents")
+	}
+
+	cache.SwapContents(nil)
+	if cache.Len() != 0 {
+		t.Error("SwapContents(nil) should empty the cache")
+	}
+
+	// Old values not kept are closed
+	old, kept := &closer{}, &closer{}
+	cache.Set(1, old)
+	cache.Set(2, kept)
+	cache.SetAutoCloseValues(true)
+	cache.SwapContents([]Entry{{2, kept}})
+	if old.closed != 1 || kept.closed != 0 {
+		t.Error("SwapContents didn't close the discarded values")
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	cache.Set(1, "one")
+	cache.Set(2, "two")
+
+	if cache.CompareAndSwap(1, "uno", "eins") {
+		t.Error("CompareAndSwap swapped a different value")
+	}
+	if cache.CompareAndSwap(3, nil, "three") || cache.Contains(3) {
+		t.Error("CompareAndSwap swapped a missing key")
+	}
+	if !cache.CompareAndSwap(1, "one", "uno") {
+		t.Error("CompareAndSwap didn't swap an equal value")
+	}
+	if key, value, _ := cache.Newest(); key != 1 || value != "uno" {
+		t.Error("CompareAndSwap didn't set the value like Set")
+	}
+
+	cache.Set(4, []int{4})
+	if cache.CompareAndSwap(4, []int{4}, nil) {
+		t.Error("Uncomparable values shouldn't match")
+	}
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	cache.Set(1, "one")
+
+	if cache.CompareAndDelete(1, "uno") || !cache.Contains(1) {
+		t.Error("CompareAndDelete removed a different value")
+	}
+	if cache.CompareAndDelete(2, nil) {
+		t.Error("CompareAndDelete removed a missing key")
+	}
+	if !cache.CompareAndDelete(1, "one") || cache.Contains(1) {
+		t.Error("CompareAndDelete didn't remove an equal value")
+	}
+}
+
+func TestMRUEviction(t *testing.T) {
+	cache := NewLRUCache(3, 1, WithMRUEviction())
+	cache.Set(1, 1)
+	cache.Set(2, 2)
+	cache.Set(3, 3)
+	cache.Get(1)
+
+	// The most recently used key (1) is evicted to make room
+	cache.Set(4, 4)
+	if cache.Contains(1) || !cache.Contains(4) || cache.Len() != 3 {
+		t.Error("The most recently used key wasn't evicted")
+	}
+
+	// Pinned keys are skipped
+	cache.Pin(4)
+	cache.Set(5, 5)
+	if !cache.Contains(4) || cache.Contains(3) {
+		t.Error("MRU eviction didn't skip the pinned key")
+	}
+
+	// Explicit removals are unchanged
+	if key, _, _ := cache.PopOldest(); key != 2 {
+		t.Errorf("PopOldest returned %v expecting 2", key)
+	}
+}
+
+func TestFIFOEviction(t *testing.T) {
+	fifo := NewLRUCache(3, 1, WithFIFOEviction())
+	lru := NewLRUCache(3, 1)
+	for _, cache := range []*LRUCache{fifo, lru} {
+		cache.Set(1, 1)
+		cache.Set(2, 2)
+		cache.Set(3, 3)
+		cache.Get(1)
+		cache.Set(2, 20)
+		cache.Set(4, 4)
+	}
+
+	// LRU evicts the least recently used key (3), FIFO the first one inserted
+	if fifo.Contains(1) || !fifo.Contains(2) || !fifo.Contains(3) || !fifo.Contains(4) {
+		t.Error("FIFO didn't evict the oldest inserted key")
+	}
+	if !lru.Contains(1) || !lru.Contains(2) || lru.Contains(3) || !lru.Contains(4) {
+		t.Error("LRU didn't evict the least recently used key")
+	}
+
+	// Updates keep their value but not their position
+	if value, _ := fifo.Peek(2); value != 20 {
+		t.Errorf("Unexpected value %v for updated key", value)
+	}
+	if keys := fifo.cache.Keys(); fmt.Sprint(keys) != "[2 3 4]" {
+		t.Errorf("Unexpected FIFO order %v", keys)
+	}
+	if keys := lru.cache.Keys(); fmt.Sprint(keys) != "[1 2 4]" {
+		t.Errorf("Unexpected LRU order %v", keys)
+	}
+
+	// Hits are still counted
+	if hits, _ := fifo.Stats(); hits != 1 {
+		t.Errorf("Expected 1 hit, got %v", hits)
+	}
+}
+
+func TestRecentHitRatio(t *testing.T) {
+	cache := NewLRUCache(10, 1, WithRecentHitRatio(time.Minute))
+	if cache.RecentHitRatio() != 0 {
+		t.Error("Hit ratio without Get calls should be 0")
+	}
+
+	cache.Set(1, 1)
+	cache.Get(1)
+	cache.Get(1)
+	cache.Get(1)
+	cache.Get(2)
+	if ratio := cache.RecentHitRatio(); ratio != 0.75 {
+		t.Errorf("RecentHitRatio returned %v expecting 0.75", ratio)
+	}
+
+	// Resetting the stats resets the window too
+	cache.ResetStats()
+	if ratio := cache.RecentHitRatio(); ratio != 0 {
+		t.Errorf("RecentHitRatio returned %v after ResetStats", ratio)
+	}
+	cache.Get(2)
+	cache.SnapshotStats()
+	if ratio := cache.RecentHitRatio(); ratio != 0 {
+		t.Errorf("RecentHitRatio returned %v after SnapshotStats", ratio)
+	}
+	cache.Get(1)
+	if ratio := cache.RecentHitRatio(); ratio != 1 {
+		t.Errorf("RecentHitRatio returned %v expecting 1", ratio)
+	}
+
+	// Without window it is the ratio since the last reset
+	cache = NewLRUCache(10, 1)
+	cache.Set(1, 1)
+	cache.Get(1)
+	cache.Get(2)
+	if ratio := cache.RecentHitRatio(); ratio != 0.5 {
+		t.Errorf("RecentHitRatio returned %v expecting 0.5", ratio)
+	}
+}
+
+func TestMinResidency(t *testing.T) {
+	cache := NewLRUCache(4, 1)
+	cache.Set(1, 1) // Cached before enabling, unprotected
+	cache.SetMinResidency(time.Hour)
+	cache.Set(2, 2)
+	cache.Set(3, 3)
+	cache.Set(4, 4)
+	cache.Get(1)
+
+	// Key 1 is the most recently used but the only one evictable
+	cache.Set(5, 5)
+	if cache.Contains(1) || !cache.Contains(2) {
+		t.Error("Prune evicted a protected entry")
+	}
+
+	// All the entries are protected, the new key is rejected
+	cache.Set(6, 6)
+	if cache.Contains(6) || cache.Len() != 4 {
+		t.Error("A new key was cached while all the entries were protected")
+	}
+
+	// Explicit removals ignore the residency
+	if key, _, _ := cache.PopOldest(); key != 2 {
+		t.Errorf("PopOldest returned %v expecting 2", key)
+	}
+
+	// Disabled
+	cache.SetMinResidency(0)
+	cache.Set(6, 6)
+	cache.Set(7, 7)
+	if cache.Contains(3) || !cache.Contains(7) {
+		t.Error("Prune didn't evict the oldest entry after disabling")
+	}
+}
+
+func TestToMap(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	if m := cache.ToMap(); len(m) != 0 {
+		t.Error("Empty cache ToMap should be empty")
+	}
+
+	cache.Set(1, "one")
+	cache.Set("two", 2)
+	m := cache.ToMap()
+	if len(m) != 2 || m[1] != "one" || m["two"] != 2 {
+		t.Errorf("Unexpected ToMap result %v", m)
+	}
+
+	// It is a copy
+	m[3] = 3
+	if cache.Contains(3) {
+		t.Error("Modifying the map changed the cache")
+	}
+}
+
+func TestRank(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	for i := 0; i < 5; i++ {
+		cache.Set(i, i)
+	}
+	cache.Get(1)
+
+	expected := map[interface{}]int{0: 0, 2: 1, 3: 2, 4: 3, 1: 4}
+	for key, rank := range expected {
+		if r, ok := cache.Rank(key); !ok || r != rank {
+			t.Errorf("Rank(%v) returned %v %v expecting %v", key, r, ok, rank)
+		}
+	}
+
+	if _, ok := cache.Rank(10); ok {
+		t.Error("Rank should fail for missing keys")
+	}
+
+	// Rank doesn't update the cache
+	if key, _, _ := cache.Oldest(); key != 0 {
+		t.Error("Rank modified the cache order")
+	}
+}
+
+func TestMissHandler(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	calls := 0
+	cache.SetMissHandler(func(key interface{}) (value interface{}, ok bool) {
+		calls++
+		if key == "missing" {
+			return nil, false
+		}
+		return fmt.Sprint("handled ", key), true
+	})
+
+	if value, ok := cache.Get(1); !ok || value != "handled 1" {
+		t.Errorf("Get returned %v %v", value, ok)
+	}
+	if !cache.Contains(1) {
+		t.Error("The handled value wasn't cached")
+	}
+	if value, _ := cache.Get(1); value != "handled 1" || calls != 1 {
+		t.Error("The handler was called for a cached key")
+	}
+
+	if _, ok := cache.Get("missing"); ok || cache.Contains("missing") {
+		t.Error("Get should miss when the handler fails")
+	}
+	if hit, miss := cache.Stats(); hit != 1 || miss != 2 {
+		t.Errorf("Stats returned hit:%v miss:%v expecting 1 2", hit, miss)
+	}
+
+	cache.SetMissHandler(nil)
+	if _, ok := cache.Get(2); ok {
+		t.Error("Get should miss without handler")
+	}
+}
+
+func TestTrimToSize(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	var evicted []interface{}
+	cache.SetOnEvict(func(key interface{}, value interface{}) {
+		evicted = append(evicted, key)
+	})
+	for i := 0; i < 8; i++ {
+		cache.Set(i, i)
+	}
+	cache.Pin(1)
+
+	if n := cache.TrimToSize(5); n != 3 || cache.Len() != 5 {
+		t.Errorf("TrimToSize evicted %v entries expecting 3", n)
+	}
+	if fmt.Sprint(evicted) != "[0 2 3]" {
+		t.Errorf("Unexpected evicted keys %v", evicted)
+	}
+	if n := cache.TrimToSize(6); n != 0 {
+		t.Error("TrimToSize to a bigger size shouldn't evict")
+	}
+
+	// The size is unchanged
+	for i := 10; i < 15; i++ {
+		cache.Set(i, i)
+	}
+	if cache.Len() != 10 {
+		t.Error("TrimToSize changed the cache size")
+	}
+
+	// Pinned entries are kept
+	if n := cache.TrimToSize(0); n != 9 || !cache.Contains(1) {
+		t.Errorf("TrimToSize(0) evicted %v entries expecting 9", n)
+	}
+}
+
+func TestOldestNewestN(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	if cache.OldestN(3) != nil || cache.NewestN(3) != nil {
+		t.Error("Empty cache should return no entries")
+	}
+
+	for i := 0; i < 5; i++ {
+		cache.Set(i, i*10)
+	}
+	cache.Get(0)
+
+	if s := fmt.Sprint(cache.OldestN(2)); s != "[{1 10} {2 20}]" {
+		t.Errorf("Unexpected OldestN result %v", s)
+	}
+	if s := fmt.Sprint(cache.NewestN(2)); s != "[{0 0} {4 40}]" {
+		t.Errorf("Unexpected NewestN result %v", s)
+	}
+	if len(cache.NewestN(100)) != 5 || cache.OldestN(0) != nil {
+		t.Error("Unexpected number of entries")
+	}
+
+	// The order isn't modified
+	if key, _, _ := cache.Oldest(); key != 1 {
+		t.Error("OldestN modified the cache")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+
+	if v, ok := cache.Increment("hits", 5); !ok || v != 5 {
+		t.Errorf("Increment returned %v %v expecting 5", v, ok)
+	}
+	if v, ok := cache.Increment("hits", -2); !ok || v != 3 {
+		t.Errorf("Increment returned %v %v expecting 3", v, ok)
+	}
+	if value, _ := cache.Get("hits"); value != int64(3) {
+		t.Errorf("Cached value is %v expecting 3", value)
+	}
+
+	cache.Set("name", "value")
+	cache.Set("int", 1) // int isn't int64
+	if _, ok := cache.Increment("name", 1); ok {
+		t.Error("Increment should fail for non int64 values")
+	}
+	if _, ok := cache.Increment("int", 1); ok {
+		t.Error("Increment should fail for non int64 values")
+	}
+
+	// Concurrent increments aren't lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cache.Increment("counter", 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _ := cache.Get("counter"); value != int64(1000) {
+		t.Errorf("Counter is %v expecting 1000", value)
+	}
+}
+
+func TestPurgeMetrics(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	cache.Set(1, 1)
+	cache.Set(2, 2)
+	cache.Purge()
+	cache.Purge()
+	cache.Set(3, 3)
+	cache.PurgeAll()
+
+	if m := cache.Metrics(); m.Purges != 3 || m.PurgedEntries != 3 {
+		t.Errorf("Metrics returned %v purges %v entries expecting 3 3",
+			m.Purges, m.PurgedEntries)
+	}
+
+	// Not reset with the stats
+	cache.ResetStats()
+	if m := cache.Metrics(); m.Purges != 3 {
+		t.Error("ResetStats reset the purge counters")
+	}
+}
+
+// Test values above the max value size aren't cached
+func TestMaxValueSize(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	cache.SetMaxValueSize(4)
+
+	cache.Set(1, []byte("1234"))
+	cache.Set(2, []byte("12345"))
+	cache.Set(3, "not bytes weigh nothing")
+	if _, ok := cache.Peek(1); !ok {
+		t.Error("Value with the max size wasn't cached")
+	}
+	if _, ok := cache.Peek(2); ok {
+		t.Error("Oversized value was cached")
+	}
+	if _, ok := cache.Peek(3); !ok {
+		t.Error("Value that isn't []byte wasn't cached")
+	}
+
+	// Oversized updates leave the cached value unchanged
+	cache.Set(1, []byte("12345"))
+	if cache.SetIfChanged(1, []byte("12345"), nil) {
+		t.Error("SetIfChanged set an oversized value")
+	}
+	if cache.CompareAndSwap(3, "not bytes weigh nothing", []byte("12345")) {
+		t.Error("CompareAndSwap set an oversized value")
+	}
+	if value, _ := cache.Peek(1); string(value.([]byte)) != "1234" {
+		t.Error("Oversized Set replaced the cached value")
+	}
+
+	cache.SwapContents([]Entry{{1, []byte("1")}, {2, []byte("12345")}})
+	if cache.Len() != 1 {
+		t.Error("SwapContents cached an oversized value")
+	}
+
+	// With a weigher it is used to measure the values
+	cache = NewLRUCache(10, 1, WithWeigher(func(value interface{}) int64 {
+		return int64(len(value.(string)))
+	}))
+	cache.SetMaxValueSize(3)
+	cache.Set(1, "abc")
+	cache.Set(2, "abcd")
+	if cache.Len() != 1 {
+		t.Error("Value measured by the weigher wasn't rejected")
+	}
+
+	// Zero disables the limit
+	cache.SetMaxValueSize(0)
+	cache.Set(2, "abcd")
+	if _, ok := cache.Peek(2); !ok {
+		t.Error("Value not cached without max value size")
+	}
+}
+
+func TestGetE(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	cache.Set(1, "one")
+
+	if value, err := cache.GetE(1); err != nil || value != "one" {
+		t.Error(fmt.Sprintf("GetE returned %v %v", value, err))
+	}
+	if value, err := cache.GetE(2); value != nil || !errors.Is(err, ErrNotFound) {
+		t.Error(fmt.Sprintf("GetE returned %v %v for a missing key", value, err))
+	}
+}
+
+func TestPruneFraction(t *testing.T) {
+	cache := NewLRUCache(20, 1)
+	cache.SetPruneFraction(0.25)
+	for i := 0; i < 20; i++ {
+		cache.Set(i, i)
+	}
+
+	if !cache.Set(20, 20) || cache.Len() != 16 {
+		t.Error(fmt.Sprintf("Expected 5 pruned entries, cache len %v", cache.Len()))
+	}
+	if _, ok := cache.Peek(4); ok {
+		t.Error("The oldest entries weren't pruned")
+	}
+	if _, ok := cache.Peek(5); !ok {
+		t.Error("Pruned too many entries")
+	}
+
+	// Prunes at least one entry
+	cache = NewLRUCache(2, 1)
+	cache.SetPruneFraction(0.1)
+	cache.Set(1, 1)
+	cache.Set(2, 2)
+	cache.Set(3, 3)
+	if cache.Len() != 2 {
+		t.Error("Small fraction didn't prune any entry")
+	}
+
+	// Zero restores pruneSize, and the fraction is capped to the whole cache
+	cache = NewLRUCache(10, 2)
+	cache.SetPruneFraction(0.5)
+	cache.SetPruneFraction(0)
+	for i := 0; i < 11; i++ {
+		cache.Set(i, i)
+	}
+	if cache.Len() != 9 {
+		t.Error(fmt.Sprintf("Expected pruneSize entries pruned, cache len %v", cache.Len()))
+	}
+	cache.SetPruneFraction(2)
+	cache.Set(11, 11)
+	cache.Set(12, 12)
+	if cache.Len() != 1 {
+		t.Error(fmt.Sprintf("Expected the whole cache pruned, cache len %v", cache.Len()))
+	}
+}
+
+// Test growing the cache keeps the entries and their order
+func TestResizeGrowInPlace(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	for i := 0; i < 10; i++ {
+		cache.Set(i, i)
+	}
+	cache.Get(0)
+
+	cache.Resize(1000, 1)
+	if cache.cache.Cap() != 1000 {
+		t.Error(fmt.Sprintf("Expected capacity 1000 got %v", cache.cache.Cap()))
+	}
+	if err := cache.cache.Validate(); err != nil {
+		t.Error(err)
+	}
+	if keys := fmt.Sprint(cache.cache.Keys()); keys != "[1 2 3 4 5 6 7 8 9 0]" {
+		t.Error(fmt.Sprintf("Resize changed the entries order %v", keys))
+	}
+}
+
+// Test Gets and Sets running while the cache is resized
+func TestResizeConcurrentGet(t *testing.T) {
+	cache := NewLRUCache(100, 1)
+	for i := 0; i < 100; i++ {
+		cache.Set(i, i)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := (g*1000 + i) % 500
+				if value, ok := cache.Get(key); ok && value != key {
+					t.Error(fmt.Sprintf("Get(%v) returned %v", key, value))
+				}
+				cache.Set(key, key)
+			}
+		}(g)
+	}
+
+	for size := 100; size <= 2000; size += 100 {
+		cache.Resize(size, 1)
+	}
+	cache.Resize(50, 1)
+	close(done)
+	wg.Wait()
+
+	if cache.Len() > 50 {
+		t.Error(fmt.Sprintf("Cache len %v above size", cache.Len()))
+	}
+	if err := cache.cache.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetOrSetFunc(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	calls := 0
+	compute := func() (interface{}, bool) {
+		calls++
+		return "computed", true
+	}
+
+	for i := 0; i < 2; i++ {
+		if value, ok := cache.GetOrSetFunc(1, compute); !ok || value != "computed" {
+			t.Error(fmt.Sprintf("GetOrSetFunc returned %v %v", value, ok))
+		}
+	}
+	if calls != 1 {
+		t.Error(fmt.Sprintf("Expected 1 call got %v", calls))
+	}
+
+	// Failed computations aren't cached
+	fail := func() (interface{}, bool) {
+		return "ignored", false
+	}
+	if value, ok := cache.GetOrSetFunc(2, fail); ok || value != nil {
+		t.Error(fmt.Sprintf("GetOrSetFunc returned %v %v for a failure", value, ok))
+	}
+	if _, ok := cache.Peek(2); ok {
+		t.Error("Failed computation was cached")
+	}
+
+	// Frozen caches don't compute
+	cache.Freeze()
+	if _, ok := cache.GetOrSetFunc(3, compute); ok || calls != 1 {
+		t.Error("Frozen cache computed a missing key")
+	}
+}
+
+// Test concurrent GetOrSetFunc calls share one computation, and a Set while
+// it is running has priority.
+func TestGetOrSetFuncConcurrent(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	calls := 0
+	compute := func() (interface{}, bool) {
+		calls++
+		close(started)
+		<-release
+		return "computed", true
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan interface{}, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		value, _ := cache.GetOrSetFunc(1, compute)
+		results <- value
+	}()
+	<-started
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, _ := cache.GetOrSetFunc(1, compute)
+			results <- value
+		}()
+	}
+	for _, miss := cache.Stats(); miss < 5; _, miss = cache.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+
+	cache.Set(1, "set")
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for value := range results {
+		if value != "set" {
+			t.Error(fmt.Sprintf("GetOrSetFunc returned %v expecting set", value))
+		}
+	}
+	if calls != 1 {
+		t.Error(fmt.Sprintf("Expected 1 call got %v", calls))
+	}
+	if value, _ := cache.Peek(1); value != "set" {
+		t.Error("The computed value overwrote the Set value")
+	}
+}
+
+// Test a panic in fn doesn't leave the key blocked
+func TestGetOrSetFuncPanic(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		cache.GetOrSetFunc("k", func() (interface{}, bool) {
+			close(started)
+			<-release
+			panic("compute failed")
+		})
+	}()
+	<-started
+
+	// A caller waiting for the call receives a miss
+	waiter := make(chan bool)
+	go func() {
+		_, ok := cache.GetOrSetFunc("k", func() (interface{}, bool) {
+			return "unexpected", true
+		})
+		waiter <- ok
+	}()
+	for _, miss := cache.Stats(); miss < 2; _, miss = cache.Stats() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	if r := <-panicked; r != "compute failed" {
+		t.Error(fmt.Sprintf("The panic wasn't propagated %v", r))
+	}
+	if <-waiter {
+		t.Error("The waiting caller didn't receive a miss")
+	}
+	if cache.IsFetching("k") {
+		t.Error("The request wasn't removed after the panic")
+	}
+
+	value, ok := cache.GetOrSetFunc("k", func() (interface{}, bool) {
+		return "computed", true
+	})
+	if !ok || value != "computed" {
+		t.Error(fmt.Sprintf("GetOrSetFunc returned %v %v after a panic", value, ok))
+	}
+}
+
+func TestMoveTo(t *testing.T) {
+	l1 := NewLRUCache(2, 1)
+	l2 := NewLRUCache(10, 1)
+	l2.Set(1, "one")
+	l2.Set(2, "two")
+
+	if !l2.MoveTo(1, l1) {
+		t.Error("MoveTo failed for a cached key")
+	}
+	if l2.Contains(1) || !l1.Contains(1) {
+		t.Error("MoveTo didn't move the key")
+	}
+	if l2.MoveTo(1, l1) {
+		t.Error("MoveTo succeeded for a missing key")
+	}
+	if !l1.MoveTo(1, l1) || !l1.Contains(1) {
+		t.Error("MoveTo to the same cache should leave the key")
+	}
+
+	// Moved keys are inserted as the newest
+	l1.Set(3, "three")
+	l2.MoveTo(2, l1) // Evicts 1
+	if l1.Contains(1) || !l1.Contains(2) {
+		t.Error("The moved key wasn't inserted as the newest")
+	}
+
+	// The destination rejects the value
+	l1.SetMaxValueSize(1)
+	l2.Set(4, []byte("big"))
+	if l2.MoveTo(4, l1) || !l2.Contains(4) {
+		t.Error("MoveTo removed a value rejected by the destination")
+	}
+
+	l1.Freeze()
+	if l2.MoveTo(4, l1) || !l2.Contains(4) {
+		t.Error("MoveTo moved to a frozen cache")
+	}
+}
+
+// Test a failed move has no side effects on dst fetches and writes
+func TestMoveToPendingFetch(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fetcher := func(key interface{}) (value interface{}, ok bool) {
+		close(started)
+		<-release
+		return "fetched", true
+	}
+	store := newWriteStore()
+	src := NewLRUCache(10, 1)
+	dst := NewFetchingLRUCache(2, 1, fetcher, 1, 10,
+		WithWriter(store.Write), WithWriteBehind(0, 0))
+	dst.Set(1, 1)
+	dst.Set(2, 2)
+	dst.Pin(1)
+	dst.Pin(2)
+	dst.Flush()
+
+	result := make(chan interface{})
+	go func() {
+		value, _ := dst.Get("k")
+		result <- value
+	}()
+	<-started
+
+	// Only pinned entries left in dst
+	src.Set("k", "moved")
+	if src.MoveTo("k", dst) || !src.Contains("k") {
+		t.Error("MoveTo succeeded without room in dst")
+	}
+	dst.Lock()
+	_, queued := dst.pendingW["k"]
+	dst.Unlock()
+	if queued || !dst.IsFetching("k") {
+		t.Error("Failed MoveTo was queued or finished the pending fetch")
+	}
+
+	// A successful move is handed to the fetch waiters and queued
+	dst.Unpin(1)
+	if !src.MoveTo("k", dst) || src.Contains("k") {
+		t.Error("MoveTo failed with room in dst")
+	}
+	if value := <-result; value != "moved" {
+		t.Error(fmt.Sprintf("Waiting Get returned %v expecting moved", value))
+	}
+	dst.Flush()
+	if value, _ := store.Get("k"); value != "moved" {
+		t.Error("Moved value wasn't queued for write-behind")
+	}
+	close(release)
+	dst.Close()
+}
+
+// Test concurrent moves in opposite directions don't deadlock
+func TestMoveToConcurrent(t *testing.T) {
+	a := NewLRUCache(100, 1)
+	b := NewLRUCache(100, 1)
+	for i := 0; i < 50; i++ {
+		a.Set(i, i)
+		b.Set(i+50, i+50)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				a.MoveTo(i%100, b)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				b.MoveTo(i%100, a)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if a.Len()+b.Len() != 100 {
+		t.Error(fmt.Sprintf("Entries lost or duplicated, %v + %v", a.Len(), b.Len()))
+	}
+	for i := 0; i < 100; i++ {
+		if a.Contains(i) == b.Contains(i) {
+			t.Error(fmt.Sprintf("Key %v in both or neither cache", i))
+		}
+	}
+}
+
+// Test MoveTo and Equal lock the caches in the same order
+func TestMoveToEqualConcurrent(t *testing.T) {
+	// Make the id order the reverse of the address order, the case where
+	// inconsistent lock orders deadlock
+	a, b := NewLRUCache(100, 1), NewLRUCache(100, 1)
+	if (reflect.ValueOf(a).Pointer() < reflect.ValueOf(b).Pointer()) == (a.id < b.id) {
+		a.id, b.id = b.id, a.id
+	}
+	for i := 0; i < 50; i++ {
+		a.Set(i, i)
+		b.Set(i+50, i+50)
+	}
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for i := 0; time.Now().Before(deadline); i++ {
+					a.MoveTo(i%100, b)
+					b.MoveTo(i%100, a)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for time.Now().Before(deadline) {
+					a.Equal(b)
+					b.Equal(a)
+				}
+			}()
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Concurrent MoveTo and Equal calls deadlocked")
+	}
+	if a.Len()+b.Len() != 100 {
+		t.Error(fmt.Sprintf("Entries lost or duplicated, %v + %v", a.Len(), b.Len()))
+	}
+}
+
 // Test stat generation
 func TestStats(t *testing.T) {
 
@@ -458,11 +2070,71 @@ func TestResetStats(t *testing.T) {
 	cache.Close()
 }
 
-func TestString(t *testing.T) {
+func TestSnapshotStats(t *testing.T) {
 	cache := NewLRUCache(100, 1)
-	fmt.Sprintf("%v", cache)
 
+	cache.Set(1, 1)
+	cache.Get(1)
+	cache.Get(1)
+	cache.Get(3)
+
+	if hit, miss := cache.SnapshotStats(); hit != 2 || miss != 1 {
+		t.Error("SnapshotStats should have returned hit:2 miss:1")
+	}
+	if hit, miss := cache.Stats(); hit != 0 || miss != 0 {
+		t.Error("SnapshotStats didn't reset the stats")
+	}
+
+	cache.Get(4)
+	if hit, miss := cache.SnapshotStats(); hit != 0 || miss != 1 {
+		t.Error("SnapshotStats should have returned hit:0 miss:1")
+	}
+}
+
+func TestDump(t *testing.T) {
+	cache := NewLRUCache(200, 1)
+	if dump := cache.Dump(); dump != "LRUCache(200, 0)[]" {
+		t.Errorf("Unexpected empty cache dump %v", dump)
+	}
+
+	cache.Set(1, 1)
+	cache.Set(2, 2)
+	cache.Set(3, 3)
+	cache.Get(1)
+	if dump := cache.Dump(); dump != "LRUCache(200, 3)[2 3 1]" {
+		t.Errorf("Unexpected dump %v", dump)
+	}
+
+	for i := 0; i < dumpMaxKeys+10; i++ {
+		cache.Set(i, i)
+	}
+	dump := cache.Dump()
+	if !strings.HasSuffix(dump, fmt.Sprintf(" %v ...10 more]", dumpMaxKeys-1)) {
+		t.Errorf("Unexpected truncated dump %v", dump)
+	}
+}
+
+func TestString(t *testing.T) {
+	cache := NewLRUCache(100, 1)
+	cache.Set(1, 1)
+	if s := fmt.Sprintf("%v", cache); s != "LRUCache(100, 1)" {
+		t.Errorf("Unexpected String %v", s)
+	}
 	cache.Close()
+
+	cache = NewLRUCache(100, 1, WithName("users"))
+	if s := fmt.Sprintf("%v", cache); s != `LRUCache("users", 100, 0)` {
+		t.Errorf("Unexpected named String %v", s)
+	}
+	if dump := cache.Dump(); dump != `LRUCache("users", 100, 0)[]` {
+		t.Errorf("Unexpected named dump %v", dump)
+	}
+	if cache.Name() != "users" || cache.Metrics().Name != "users" {
+		t.Error("Cache name not returned")
+	}
+	if NewLRUCache(100, 1).Name() != "" {
+		t.Error("Unnamed cache has a name")
+	}
 }
 
 func TestConcurrency(t *testing.T) {
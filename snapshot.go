@@ -0,0 +1,66 @@
+package simplelru
+
+import (
+	"encoding/gob"
+	"io"
+)
+
+// LoadStream reads gob encoded Entry values from r until EOF, and Sets each
+// one as it is decoded, so the stream doesn't need to fit in memory. The
+// cache is pruned as usual when it is full, so for streams bigger than the
+// cache only the last entries remain. Keys and values of types other than
+// the basic ones must be registered with gob.Register by the encoder and the
+// decoder. Returns the first decoding error, the entries decoded before it
+// remain cached.
+func (c *LRUCache) LoadStream(r io.Reader) error {
+	dec := gob.NewDecoder(r)
+	for {
+		var e Entry
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		c.Set(e.Key, e.Value)
+	}
+}
+
+// Snapshot writes the cached entries to w as a stream of gob encoded Entry
+// values, from the least to the most recently used, so loading them in the
+// same order with Restore or LoadStream reproduces the eviction order. The
+// entries are copied under the lock and encoded after releasing it. Pins,
+// tags and the access history of WithSampledEviction aren't included.
+func (c *LRUCache) Snapshot(w io.Writer) error {
+	c.Lock()
+	entries := c.walkN(c.cache.Iterator(), c.cache.Len())
+	c.Unlock()
+
+	enc := gob.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore replaces the cache contents with a stream written by Snapshot,
+// the last entry read becomes the most recently used. The whole stream is
+// decoded before swapping the contents (see SwapContents), so the cache is
+// left unchanged if decoding fails. Use LoadStream for streams that don't
+// fit in memory.
+func (c *LRUCache) Restore(r io.Reader) error {
+	var entries []Entry
+	dec := gob.NewDecoder(r)
+	for {
+		var e Entry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+	}
+	c.SwapContents(entries)
+	return nil
+}
@@ -0,0 +1,120 @@
+package simplelru
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"testing"
+)
+
+// encodeEntries returns a gob stream with the entries
+func encodeEntries(t *testing.T, entries []Entry) *bytes.Buffer {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &buf
+}
+
+func TestLoadStream(t *testing.T) {
+	cache := NewLRUCache(3, 1)
+	cache.Set("old", 0)
+
+	stream := encodeEntries(t, []Entry{{1, "one"}, {"two", 2}, {3, 3.0}})
+	if err := cache.LoadStream(stream); err != nil {
+		t.Error(err)
+	}
+	if s := fmt.Sprint(cache.OldestN(3)); s != "[{1 one} {two 2} {3 3}]" {
+		t.Errorf("Unexpected contents %v", s)
+	}
+
+	// Pruned as it loads
+	var entries []Entry
+	for i := 0; i < 100; i++ {
+		entries = append(entries, Entry{i, i})
+	}
+	if err := cache.LoadStream(encodeEntries(t, entries)); err != nil {
+		t.Error(err)
+	}
+	if s := fmt.Sprint(cache.OldestN(3)); cache.Len() != 3 || s != "[{97 97} {98 98} {99 99}]" {
+		t.Errorf("Unexpected contents %v", s)
+	}
+
+	// Empty stream
+	if err := cache.LoadStream(&bytes.Buffer{}); err != nil {
+		t.Error(err)
+	}
+
+	// Corrupted stream
+	stream = encodeEntries(t, []Entry{{"a", 1}, {"b", 2}})
+	data := stream.Bytes()
+	if err := cache.LoadStream(bytes.NewReader(data[:len(data)-2])); err == nil {
+		t.Error("LoadStream should fail with a truncated stream")
+	}
+	if !cache.Contains("a") {
+		t.Error("The entries before the error weren't cached")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	cache := NewLRUCache(5, 1)
+	for i := 0; i < 5; i++ {
+		cache.Set(i, fmt.Sprint(i))
+	}
+	cache.Get(0)
+	cache.Get(2)
+
+	var buf bytes.Buffer
+	if err := cache.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	restored := NewLRUCache(5, 1)
+	restored.Set("old", 0)
+	if err := restored.Restore(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(restored.OldestN(5)) != fmt.Sprint(cache.OldestN(5)) {
+		t.Errorf("Restored order %v expected %v", restored.OldestN(5), cache.OldestN(5))
+	}
+
+	// The next evictions are the same in both caches
+	evictions := func(c *LRUCache) []interface{} {
+		var evicted []interface{}
+		c.SetOnEvict(func(key, value interface{}) {
+			evicted = append(evicted, key)
+		})
+		for i := 10; i < 14; i++ {
+			c.Set(i, i)
+		}
+		return evicted
+	}
+	expected := evictions(cache)
+	if got := evictions(restored); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Restored cache evicted %v expected %v", got, expected)
+	}
+	if fmt.Sprint(expected) != "[1 3 4 0]" {
+		t.Errorf("Unexpected evictions %v", expected)
+	}
+
+	// LoadStream reproduces the same order
+	loaded := NewLRUCache(5, 1)
+	if err := loaded.LoadStream(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(loaded.cache.Keys()); s != "[1 3 4 0 2]" {
+		t.Errorf("Unexpected LoadStream order %v", s)
+	}
+
+	// A failed restore leaves the cache unchanged
+	if err := restored.Restore(bytes.NewReader(data[:len(data)-2])); err == nil {
+		t.Error("Restore should fail with a truncated stream")
+	}
+	if restored.Len() != 5 || !restored.Contains(13) {
+		t.Error("Failed Restore modified the cache")
+	}
+}
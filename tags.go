@@ -0,0 +1,91 @@
+package simplelru
+
+// tagIndex maps the tags of the cached entries to their keys, and the keys
+// to their tags so they can be removed when the entry is.
+type tagIndex struct {
+	keys map[string]map[interface{}]struct{}
+	tags map[interface{}][]string
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		keys: make(map[string]map[interface{}]struct{}),
+		tags: make(map[interface{}][]string),
+	}
+}
+
+// Set replaces the tags of key
+func (t *tagIndex) Set(key interface{}, tags []string) {
+	t.Remove(key)
+	if len(tags) == 0 {
+		return
+	}
+
+	keyTags := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		keys, ok := t.keys[tag]
+		if !ok {
+			keys = make(map[interface{}]struct{})
+			t.keys[tag] = keys
+		}
+		if _, dup := keys[key]; !dup {
+			keys[key] = struct{}{}
+			keyTags = append(keyTags, tag)
+		}
+	}
+	t.tags[key] = keyTags
+}
+
+// Remove all the key tags
+func (t *tagIndex) Remove(key interface{}) {
+	for _, tag := range t.tags[key] {
+		keys := t.keys[tag]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(t.keys, tag)
+		}
+	}
+	delete(t.tags, key)
+}
+
+// Keys returns the keys tagged with tag
+func (t *tagIndex) Keys(tag string) []interface{} {
+	keys := make([]interface{}, 0, len(t.keys[tag]))
+	for key := range t.keys[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// SetWithTags is the same as Set, but also tags the entry so it can be
+// removed with InvalidateTag. The tags replace any previous tags of the key,
+// while Set leaves them unchanged. Tags are dropped when the entry is
+// removed, evicted or purged.
+func (c *LRUCache) SetWithTags(key interface{}, value interface{}, tags ...string) (pruned bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.frozen || c.oversized(value) {
+		return false
+	}
+
+	pruned = c.setLocked(key, value)
+	if _, cached := c.cache.Get(key); !cached {
+		return // Couldn't be cached, only pinned entries left
+	}
+	if c.tags == nil {
+		c.tags = newTagIndex()
+	}
+	c.tags.Set(key, tags)
+	return
+}
+
+// InvalidateTag removes all the entries tagged with tag, and returns the
+// number of entries removed.
+func (c *LRUCache) InvalidateTag(tag string) int {
+	c.Lock()
+	defer c.Unlock()
+	if c.frozen || c.tags == nil {
+		return 0
+	}
+	return c.deleteEntries(c.tags.Keys(tag))
+}
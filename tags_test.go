@@ -0,0 +1,91 @@
+package simplelru
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestInvalidateTag(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	if cache.InvalidateTag("user:42") != 0 {
+		t.Error("InvalidateTag removed entries without tags")
+	}
+
+	cache.SetWithTags("profile:42", 1, "user:42")
+	cache.SetWithTags("posts:42", 2, "user:42", "posts")
+	cache.SetWithTags("posts:7", 3, "user:7", "posts")
+	cache.Set("other", 4)
+
+	if n := cache.InvalidateTag("user:42"); n != 2 {
+		t.Error(fmt.Sprintf("Expected 2 invalidated entries got %v", n))
+	}
+	if _, ok := cache.Peek("posts:42"); ok {
+		t.Error("Tagged entry wasn't invalidated")
+	}
+	if cache.Len() != 2 {
+		t.Error("Entries without the tag were invalidated")
+	}
+
+	// Invalidated entries are removed from the other tags
+	if n := cache.InvalidateTag("posts"); n != 1 {
+		t.Error(fmt.Sprintf("Expected 1 invalidated entry got %v", n))
+	}
+	if n := cache.InvalidateTag("user:42"); n != 0 {
+		t.Error("Tag invalidated twice")
+	}
+	if _, ok := cache.Peek("other"); !ok {
+		t.Error("Untagged entry was invalidated")
+	}
+}
+
+// Test SetWithTags replaces the key tags, and Set keeps them
+func TestSetWithTagsUpdate(t *testing.T) {
+	cache := NewLRUCache(10, 1)
+	cache.SetWithTags(1, "one", "a", "b", "a")
+	cache.SetWithTags(1, "uno", "b")
+	if cache.InvalidateTag("a") != 0 {
+		t.Error("Replaced tag still invalidates the entry")
+	}
+
+	cache.Set(1, "one")
+	if cache.InvalidateTag("b") != 1 {
+		t.Error("Set dropped the entry tags")
+	}
+
+	cache.SetWithTags(2, "two", "b")
+	cache.SetWithTags(2, "dos")
+	if cache.InvalidateTag("b") != 0 {
+		t.Error("SetWithTags without tags kept the old tags")
+	}
+}
+
+// Test tags are cleaned up when the entries are removed in other ways
+func TestTagsCleanup(t *testing.T) {
+	cache := NewLRUCache(2, 1)
+	cache.SetWithTags(1, 1, "tag")
+	cache.SetWithTags(2, 2, "tag")
+	cache.SetWithTags(3, 3, "other") // Evicts 1
+	cache.Remove(2)
+
+	if len(cache.tags.tags) != 1 || len(cache.tags.keys) != 1 {
+		t.Error(fmt.Sprintf("Tags weren't cleaned up %v", cache.tags.keys))
+	}
+
+	// The key is cached again without tags
+	cache.Set(1, 1)
+	if cache.InvalidateTag("tag") != 0 {
+		t.Error("Evicted entry tags were kept")
+	}
+
+	cache.Purge()
+	if len(cache.tags.tags) != 0 || cache.InvalidateTag("other") != 0 {
+		t.Error("Purge didn't clear the tags")
+	}
+
+	// Frozen caches aren't modified
+	cache.SetWithTags(1, 1, "tag")
+	cache.Freeze()
+	if cache.SetWithTags(2, 2, "tag") || cache.InvalidateTag("tag") != 0 {
+		t.Error("Frozen cache was modified")
+	}
+}
@@ -0,0 +1,89 @@
+package simplelru
+
+import "sort"
+
+// KeyCount is a key and the number of times it was counted
+type KeyCount struct {
+	Key   interface{}
+	Count uint64
+}
+
+// spaceSaving counts the most frequent keys using a bounded number of
+// counters (Metwally's Space-Saving algorithm). When all the counters are
+// used a new key replaces the key with the lowest count, inheriting it, so
+// counts are overestimated by at most the lowest count, but a key that
+// occurs more often than that is never lost.
+type spaceSaving struct {
+	counts   map[interface{}]uint64
+	capacity int
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{
+		counts:   make(map[interface{}]uint64, capacity),
+		capacity: capacity,
+	}
+}
+
+// Add counts one occurrence of key
+func (s *spaceSaving) Add(key interface{}) {
+	if _, ok := s.counts[key]; ok || len(s.counts) < s.capacity {
+		s.counts[key]++
+		return
+	}
+
+	// Replace the key with the lowest count
+	var minKey interface{}
+	var minCount uint64
+	first := true
+	for k, count := range s.counts {
+		if first || count < minCount {
+			minKey, minCount, first = k, count, false
+		}
+	}
+	delete(s.counts, minKey)
+	s.counts[key] = minCount + 1
+}
+
+// Top returns up to n keys with the highest counts, from the highest
+func (s *spaceSaving) Top(n int) []KeyCount {
+	top := make([]KeyCount, 0, len(s.counts))
+	for key, count := range s.counts {
+		top = append(top, KeyCount{key, count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].Count > top[j].Count
+	})
+	if n < len(top) {
+		top = top[:n]
+	}
+	return top
+}
+
+// WithEvictionTracking counts how many times each key is evicted, to find
+// the keys that keep cycling in and out of a cache too small for its working
+// set (see TopEvicted). Only the capacity most evicted keys are tracked, when
+// a new key is evicted and all the counters are in use it replaces the key
+// evicted the fewest times. Every eviction updates the counters, and
+// replacing a key scans all of them, so keep the capacity small.
+func WithEvictionTracking(capacity int) Option {
+	return func(c *LRUCache) {
+		if capacity < 1 {
+			panic("WithEvictionTracking: min capacity is 1")
+		}
+		c.evictedKeys = newSpaceSaving(capacity)
+	}
+}
+
+// TopEvicted returns up to n of the most evicted keys with WithEvictionTracking,
+// from the most evicted. The counts are approximate, they can exceed the real
+// number of evictions by at most the count of the least evicted tracked key.
+// Returns nil without eviction tracking.
+func (c *LRUCache) TopEvicted(n int) []KeyCount {
+	c.Lock()
+	defer c.Unlock()
+	if c.evictedKeys == nil || n <= 0 {
+		return nil
+	}
+	return c.evictedKeys.Top(n)
+}
@@ -0,0 +1,62 @@
+package simplelru
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	s := newSpaceSaving(3)
+	for i := 0; i < 10; i++ {
+		s.Add("hot")
+	}
+	for i := 0; i < 5; i++ {
+		s.Add("warm")
+	}
+	s.Add("a")
+	s.Add("b") // Replaces a inheriting its count
+
+	top := s.Top(10)
+	if len(top) != 3 {
+		t.Errorf("Expected 3 tracked keys got %v", top)
+	}
+	if fmt.Sprint(top[:2]) != "[{hot 10} {warm 5}]" {
+		t.Errorf("Unexpected top keys %v", top)
+	}
+	if top[2] != (KeyCount{"b", 2}) {
+		t.Errorf("Expected b to replace a with count 2, got %v", top[2])
+	}
+	if top := s.Top(1); len(top) != 1 || top[0].Key != "hot" {
+		t.Errorf("Unexpected top key %v", top)
+	}
+}
+
+func TestTopEvicted(t *testing.T) {
+	cache := NewLRUCache(2, 1, WithEvictionTracking(10))
+
+	// Cycle three keys through a cache of two
+	for i := 0; i < 9; i++ {
+		cache.Set(i%3, i)
+	}
+	cache.Set("once", 0)
+	cache.Set("other", 0)
+	cache.Set("last", 0) // Evicts once
+
+	top := cache.TopEvicted(3)
+	if len(top) != 3 || top[0].Count != 3 || top[1].Count != 3 || top[2].Count != 3 {
+		t.Errorf("Unexpected most evicted keys %v", top)
+	}
+	if top := cache.TopEvicted(10); len(top) != 4 || top[3] != (KeyCount{"once", 1}) {
+		t.Errorf("Expected 4 evicted keys got %v", top)
+	}
+
+	// Removed keys aren't evictions
+	cache.Remove("other")
+	if top := cache.TopEvicted(10); len(top) != 4 {
+		t.Errorf("Remove was counted as an eviction %v", top)
+	}
+
+	if NewLRUCache(2, 1).TopEvicted(10) != nil {
+		t.Error("TopEvicted should be nil without eviction tracking")
+	}
+}
@@ -0,0 +1,53 @@
+package simplelru
+
+import "time"
+
+// Tracer receives the timing of cache operations, to diagnose lock
+// contention. See WithTracer.
+type Tracer interface {
+	// Trace is called after each Get or Set (op is "Get", "GetNoPromote"
+	// or "Set") with the time spent waiting to acquire the cache lock and
+	// the time spent holding it. Time spent waiting for a fetch isn't
+	// included. It is called without the cache lock held, possibly from
+	// several goroutines at once.
+	Trace(op string, lockWait time.Duration, work time.Duration)
+}
+
+// WithTracer sets a Tracer to time the Get and Set operations. Without a
+// tracer the operations aren't timed.
+func WithTracer(tracer Tracer) Option {
+	return func(c *LRUCache) {
+		c.tracer = tracer
+	}
+}
+
+// lockTime holds when an operation started waiting for the lock, and when
+// it got it.
+type lockTime struct {
+	start  time.Time
+	locked time.Time
+}
+
+// lockTraced acquires the cache lock, timing it when there is a tracer
+func (c *LRUCache) lockTraced() (t lockTime) {
+	if c.tracer == nil {
+		c.Lock()
+		return
+	}
+	t.start = time.Now()
+	c.Lock()
+	t.locked = time.Now()
+	return
+}
+
+// unlockTraced releases the cache lock acquired with lockTraced, and
+// reports the operation timing to the tracer.
+func (c *LRUCache) unlockTraced(op string, t lockTime) {
+	if c.tracer == nil {
+		c.Unlock()
+		return
+	}
+	end := time.Now()
+	c.Unlock()
+	c.tracer.Trace(op, t.locked.Sub(t.start), end.Sub(t.locked))
+}
@@ -0,0 +1,38 @@
+package simplelru
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Tracer counting the traced operations
+type countTracer struct {
+	ops  map[string]int
+	lock sync.Mutex
+}
+
+func (t *countTracer) Trace(op string, lockWait time.Duration, work time.Duration) {
+	t.lock.Lock()
+	t.ops[op]++
+	t.lock.Unlock()
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &countTracer{ops: make(map[string]int)}
+	cache := NewLRUCache(10, 1, WithTracer(tracer))
+
+	cache.Set(1, 1)
+	cache.Set(2, 2)
+	cache.Get(1)
+	cache.Get(3)
+	cache.GetNoPromote(2)
+	cache.Peek(1) // Not traced
+
+	if tracer.ops["Set"] != 2 || tracer.ops["Get"] != 2 || tracer.ops["GetNoPromote"] != 1 {
+		t.Errorf("Unexpected traced operations %v", tracer.ops)
+	}
+	if len(tracer.ops) != 3 {
+		t.Errorf("Unexpected traced operations %v", tracer.ops)
+	}
+}
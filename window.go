@@ -0,0 +1,46 @@
+package simplelru
+
+import "time"
+
+// slidingWindow counts events over the last len(counts) seconds, using one
+// bucket per second that is reset when it is reused.
+type slidingWindow struct {
+	counts []uint64
+	stamps []int64 // Unix second of each bucket count
+}
+
+func newSlidingWindow(seconds int) *slidingWindow {
+	return &slidingWindow{
+		counts: make([]uint64, seconds),
+		stamps: make([]int64, seconds),
+	}
+}
+
+// Add n events at time now
+func (w *slidingWindow) Add(now time.Time, n uint64) {
+	sec := now.Unix()
+	i := int(sec % int64(len(w.counts)))
+	if w.stamps[i] != sec {
+		w.stamps[i] = sec
+		w.counts[i] = 0
+	}
+	w.counts[i] += n
+}
+
+// Sum returns the number of events in the window ending at time now
+func (w *slidingWindow) Sum(now time.Time) (sum uint64) {
+	sec := now.Unix()
+	for i, stamp := range w.stamps {
+		if sec-stamp < int64(len(w.counts)) && stamp <= sec {
+			sum += w.counts[i]
+		}
+	}
+	return sum
+}
+
+// Reset clears all the counts
+func (w *slidingWindow) Reset() {
+	for i := range w.counts {
+		w.counts[i], w.stamps[i] = 0, 0
+	}
+}
@@ -0,0 +1,34 @@
+package simplelru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	w := newSlidingWindow(10)
+	start := time.Unix(1000, 0)
+
+	w.Add(start, 5)
+	w.Add(start.Add(500*time.Millisecond), 1)
+	w.Add(start.Add(3*time.Second), 4)
+	if sum := w.Sum(start.Add(3 * time.Second)); sum != 10 {
+		t.Errorf("Sum returned %v expecting 10", sum)
+	}
+
+	// The first bucket leaves the window
+	if sum := w.Sum(start.Add(10 * time.Second)); sum != 4 {
+		t.Errorf("Sum returned %v expecting 4", sum)
+	}
+
+	// Reused buckets start from zero
+	w.Add(start.Add(20*time.Second), 2)
+	if sum := w.Sum(start.Add(20 * time.Second)); sum != 2 {
+		t.Errorf("Sum returned %v expecting 2", sum)
+	}
+
+	w.Reset()
+	if sum := w.Sum(start.Add(20 * time.Second)); sum != 0 {
+		t.Errorf("Sum returned %v after Reset", sum)
+	}
+}
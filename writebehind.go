@@ -0,0 +1,92 @@
+package simplelru
+
+import "time"
+
+// WithWriteBehind makes Set calls write their values to the backing store
+// asynchronously with the writer function (see WithWriter). Set updates the
+// cache immediately and queues the value, and a background goroutine writes
+// the queued values every interval, or as soon as there are batchSize values
+// queued. A zero interval or batchSize disables that flush trigger. Put
+// still writes synchronously, bypassing the queue (see Put).
+//
+// Only the last value Set for a key is written. Values that fail to be
+// written are retried on the next flush. Queued values are lost if the
+// process exits before they are flushed, use Flush or Close to make sure
+// they are written.
+func WithWriteBehind(interval time.Duration, batchSize int) Option {
+	return func(c *LRUCache) {
+		c.writeBehind = true
+		c.writeInterval = interval
+		c.writeBatchSize = batchSize
+		c.pendingW = make(map[interface{}]interface{})
+		c.flushSignal = make(chan struct{}, 1)
+	}
+}
+
+// queueWrite queues a value for the write-behind flusher, must be called
+// with the lock held.
+func (c *LRUCache) queueWrite(key interface{}, value interface{}) {
+	c.pendingW[key] = value
+	if c.writeBatchSize > 0 && len(c.pendingW) >= c.writeBatchSize {
+		select {
+		case c.flushSignal <- struct{}{}:
+		default: // Flush already signaled
+		}
+	}
+}
+
+// goFlushFunc is the write-behind flusher goroutine
+func (c *LRUCache) goFlushFunc() {
+	defer c.wg.Done()
+
+	var tick <-chan time.Time
+	if c.writeInterval > 0 {
+		ticker := time.NewTicker(c.writeInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+		case <-c.flushSignal:
+		case <-c.done:
+			return // Close flushes the remaining values
+		}
+		c.Flush()
+	}
+}
+
+// Flush writes all the values queued by Set in write-behind mode to the
+// backing store, and returns the first write error. Values that couldn't be
+// written stay queued for the next flush.
+func (c *LRUCache) Flush() (err error) {
+	if !c.writeBehind {
+		return nil
+	}
+
+	// Only one flush at a time, so writes of the same key aren't reordered
+	c.flushLock.Lock()
+	defer c.flushLock.Unlock()
+
+	c.Lock()
+	pending := c.pendingW
+	c.pendingW = make(map[interface{}]interface{})
+	c.Unlock()
+
+	for key, value := range pending {
+		if werr := c.writer(key, value); werr != nil {
+			if err == nil {
+				err = werr
+			}
+
+			// Requeue unless there is a newer value
+			c.Lock()
+			if _, queued := c.pendingW[key]; !queued {
+				c.pendingW[key] = value
+			}
+			c.Unlock()
+		}
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+package simplelru
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Mock backing store for write-behind tests (concurrency-safe)
+type writeStore struct {
+	values map[interface{}]interface{}
+	writes int
+	fail   bool
+	lock   sync.Mutex
+}
+
+func newWriteStore() *writeStore {
+	return &writeStore{values: make(map[interface{}]interface{})}
+}
+
+func (s *writeStore) Write(key interface{}, value interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.fail {
+		return errors.New("write failure")
+	}
+	s.writes++
+	s.values[key] = value
+	return nil
+}
+
+func (s *writeStore) Get(key interface{}) (value interface{}, writes int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.values[key], s.writes
+}
+
+func (s *writeStore) SetFail(fail bool) {
+	s.lock.Lock()
+	s.fail = fail
+	s.lock.Unlock()
+}
+
+// Test Flush writes only the last value of each key
+func TestWriteBehindFlush(t *testing.T) {
+	store := newWriteStore()
+	cache := NewLRUCache(100, 10, WithWriter(store.Write), WithWriteBehind(0, 0))
+
+	cache.Set(1, "one")
+	cache.Set(1, "uno")
+	cache.Set(2, "two")
+
+	if value, ok := cache.Peek(1); !ok || value != "uno" {
+		t.Error("Set didn't update the cache immediately")
+	}
+	if _, writes := store.Get(1); writes != 0 {
+		t.Error("Set wrote to the store before flushing")
+	}
+
+	if err := cache.Flush(); err != nil {
+		t.Error("Unexpected Flush error: ", err)
+	}
+	if value, writes := store.Get(1); value != "uno" || writes != 2 {
+		t.Error(fmt.Sprintf("Unexpected store state %v %v", value, writes))
+	}
+
+	// Failed writes are retried on the next flush
+	store.SetFail(true)
+	cache.Set(3, "three")
+	if err := cache.Flush(); err == nil {
+		t.Error("Flush didn't return the write error")
+	}
+	store.SetFail(false)
+	cache.Flush()
+	if value, _ := store.Get(3); value != "three" {
+		t.Error("Failed write wasn't retried")
+	}
+
+	// Close flushes the queued values
+	cache.Set(4, "four")
+	cache.Close()
+	if value, _ := store.Get(4); value != "four" {
+		t.Error("Close didn't flush the queued values")
+	}
+}
+
+// Test Put writes synchronously without queueing the value
+func TestWriteBehindPut(t *testing.T) {
+	store := newWriteStore()
+	cache := NewLRUCache(100, 10, WithWriter(store.Write), WithWriteBehind(0, 0))
+
+	cache.Set(1, "one")
+	if err := cache.Put(1, "uno"); err != nil {
+		t.Error("Unexpected Put error: ", err)
+	}
+	if value, writes := store.Get(1); value != "uno" || writes != 1 {
+		t.Error(fmt.Sprintf("Put didn't write synchronously %v %v", value, writes))
+	}
+	if value, _ := cache.Peek(1); value != "uno" {
+		t.Error("Put didn't update the cache")
+	}
+
+	// Neither the Put value nor the older Set value are written again
+	cache.Close()
+	if value, writes := store.Get(1); value != "uno" || writes != 1 {
+		t.Error(fmt.Sprintf("Put value was written again %v %v", value, writes))
+	}
+}
+
+// Test the flusher goroutine triggers
+func TestWriteBehindFlusher(t *testing.T) {
+	store := newWriteStore()
+
+	// Flush by batch size
+	cache := NewLRUCache(100, 10, WithWriter(store.Write), WithWriteBehind(0, 3))
+	cache.Set(1, 1)
+	cache.Set(2, 2)
+	cache.Set(3, 3)
+	for i := 0; i < 100; i++ {
+		if _, writes := store.Get(1); writes == 3 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, writes := store.Get(1); writes != 3 {
+		t.Error("Flusher didn't write the full batch")
+	}
+	cache.Close()
+
+	// Flush by interval
+	store = newWriteStore()
+	cache = NewLRUCache(100, 10, WithWriter(store.Write), WithWriteBehind(20*time.Millisecond, 0))
+	cache.Set(1, 1)
+	time.Sleep(100 * time.Millisecond)
+	if value, _ := store.Get(1); value != 1 {
+		t.Error("Flusher didn't write after the interval")
+	}
+	cache.Close()
+}